@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    "athera/internal/lang"
+)
+
+// benchRuns is how many times each engine runs a benchmark; the fastest
+// run is reported.
+const benchRuns = 3
+
+// runBench runs every .ath program in dir on the tree walker and on the
+// bytecode VM, reports the time each took and the speedup, and fails if
+// the two engines printed different output.
+func runBench(dir string) {
+    files, err := filepath.Glob(filepath.Join(dir, "*.ath"))
+    if err != nil || len(files) == 0 {
+        fmt.Printf("Error: no .ath benchmarks found in %s\n", dir)
+        os.Exit(1)
+    }
+
+    fmt.Printf("%-16s %12s %12s %8s\n", "benchmark", "tree walker", "vm", "speedup")
+    mismatches := 0
+    for _, file := range files {
+        src, err := os.ReadFile(file)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+        walkTime, walkOut := benchEngine(file, string(src), true)
+        vmTime, vmOut := benchEngine(file, string(src), false)
+        fmt.Printf("%-16s %12s %12s %7.2fx\n", filepath.Base(file), walkTime.Round(time.Microsecond), vmTime.Round(time.Microsecond), float64(walkTime)/float64(vmTime))
+        if walkOut != vmOut {
+            fmt.Printf("  output differs:\n    tree walker: %q\n    vm:          %q\n", walkOut, vmOut)
+            mismatches++
+        }
+    }
+    if mismatches > 0 {
+        fmt.Printf("%d benchmark(s) gave different output on the two engines\n", mismatches)
+        os.Exit(1)
+    }
+}
+
+// benchEngine runs src benchRuns times on one engine and returns the
+// fastest time and what the program printed, including any error.
+func benchEngine(file, src string, treeWalker bool) (time.Duration, string) {
+    var best time.Duration
+    var out bytes.Buffer
+    for run := 0; run < benchRuns; run++ {
+        out.Reset()
+        opts := lang.Options{TreeWalker: treeWalker, Stdout: &out, Stderr: &out}
+        start := time.Now()
+        err := lang.RunSource(src, opts)
+        elapsed := time.Since(start)
+        if err != nil {
+            fmt.Fprintf(&out, "Error: %v\n", err)
+        }
+        if run == 0 || elapsed < best {
+            best = elapsed
+        }
+    }
+    return best, out.String()
+}
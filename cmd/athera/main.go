@@ -2,19 +2,25 @@ package main
 
 import (
     "bufio"
+    "errors"
     "flag"
     "fmt"
     "os"
     "strings"
 
     "athera/internal/lang"
+    "athera/internal/project"
 )
 
 func main() {
     flag.Usage = func() {
         fmt.Fprintf(os.Stderr, "Athera (Go) - Phase 1 minimal runtime\n")
         fmt.Fprintf(os.Stderr, "Usage:\n")
-        fmt.Fprintf(os.Stderr, "  athera run <file.ath>\n")
+        fmt.Fprintf(os.Stderr, "  athera run [--max-depth N] [--max-iterations N] [--lenient] [--timeout D] [--tree-walker] [file.ath]\n")
+        fmt.Fprintf(os.Stderr, "  athera check <file.ath>\n")
+        fmt.Fprintf(os.Stderr, "  athera install [--name N] [--no-save] [dir | archive | git repo]\n")
+        fmt.Fprintf(os.Stderr, "  athera lock\n")
+        fmt.Fprintf(os.Stderr, "  athera bench [dir]\n")
         fmt.Fprintf(os.Stderr, "  athera repl\n")
     }
 
@@ -28,14 +34,61 @@ func main() {
 
     switch args[0] {
     case "run":
+        runFlags := flag.NewFlagSet("run", flag.ExitOnError)
+        maxDepth := runFlags.Int("max-depth", lang.DefaultMaxCallDepth, "maximum task call depth")
+        maxIterations := runFlags.Int("max-iterations", lang.DefaultMaxIterations, "maximum passes of a single loop")
+        lenient := runFlags.Bool("lenient", false, "treat undefined variables as bare-word strings")
+        timeout := runFlags.Duration("timeout", 0, "stop the program after this long, e.g. 30s (0 for no limit)")
+        treeWalker := runFlags.Bool("tree-walker", false, "run on the tree-walking evaluator instead of the bytecode VM")
+        runFlags.Parse(args[1:])
+        opts := lang.Options{MaxCallDepth: *maxDepth, MaxIterations: *maxIterations, Lenient: *lenient, Timeout: *timeout, TreeWalker: *treeWalker}
+        // Inside a project, its module paths and dependencies apply to any
+        // file run, and the entry point is run when no file is given.
+        path := runFlags.Arg(0)
+        if m := loadProject(); m != nil {
+            opts.ModulePaths = m.ModulePaths()
+            if path == "" {
+                path = m.EntryPath()
+            }
+        }
+        if path == "" {
+            fmt.Printf("Error: athera run requires a file path, or an %s in the current folder or above\n", project.ManifestFile)
+            os.Exit(1)
+        }
+        if err := lang.RunFile(path, opts); err != nil {
+            var parseErr *lang.ParseError
+            if errors.As(err, &parseErr) {
+                printDiagnostics(parseErr.Diagnostics)
+                os.Exit(1)
+            }
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+    case "check":
         if len(args) < 2 {
-            fmt.Println("Error: athera run requires a file path")
+            fmt.Println("Error: athera check requires a file path")
             os.Exit(1)
         }
-        if err := lang.RunFile(args[1]); err != nil {
+        diags, err := lang.CheckFile(args[1])
+        if err != nil {
             fmt.Printf("Error: %v\n", err)
             os.Exit(1)
         }
+        if len(diags) > 0 {
+            printDiagnostics(diags)
+            os.Exit(1)
+        }
+        fmt.Printf("%s: no problems found\n", args[1])
+    case "install":
+        runInstall(args[1:])
+    case "lock":
+        runLock()
+    case "bench":
+        dir := "benchmarks"
+        if len(args) > 1 {
+            dir = args[1]
+        }
+        runBench(dir)
     case "repl":
         runRepl()
     default:
@@ -50,6 +103,7 @@ func runRepl() {
     fmt.Println("Type 'exit' or 'quit' to leave. Enter blank line to execute a multi-line block.")
 
     interp := lang.NewInterpreter()
+    cache := lang.NewProgramCache(replCacheSize)
     scanner := bufio.NewScanner(os.Stdin)
     var buffer []string
 
@@ -79,11 +133,7 @@ func runRepl() {
                 continue
             }
             src := strings.Join(buffer, "\n")
-            lexer := lang.NewLexer(src)
-            tokens := lexer.Tokenize()
-            parser := lang.NewParser(tokens)
-            nodes := parser.Parse()
-            interp.Execute(nodes)
+            executeReplSource(interp, cache, src)
             buffer = buffer[:0]
             continue
         }
@@ -94,13 +144,38 @@ func runRepl() {
         if len(buffer) == 1 && !strings.HasSuffix(trimmed, ":") {
             src := buffer[0]
             buffer = buffer[:0]
-            lexer := lang.NewLexer(src)
-            tokens := lexer.Tokenize()
-            parser := lang.NewParser(tokens)
-            nodes := parser.Parse()
-            interp.Execute(nodes)
+            executeReplSource(interp, cache, src)
         }
     }
 
     fmt.Println("Goodbye.")
 }
+
+// replCacheSize is how many distinct REPL entries stay compiled.
+const replCacheSize = 256
+
+// executeReplSource compiles and runs one REPL entry, reporting syntax
+// errors instead of executing a partially parsed program. Entries typed
+// before come from the cache.
+func executeReplSource(interp *lang.Interpreter, cache *lang.ProgramCache, src string) {
+    prog, diags := cache.Compile("<repl>", src)
+    if len(diags) > 0 {
+        printDiagnostics(diags)
+        return
+    }
+    if err := interp.Run(prog); err != nil {
+        fmt.Printf("Error: %v\n", err)
+    }
+}
+
+// printDiagnostics writes every diagnostic followed by an error count.
+func printDiagnostics(diags []lang.Diagnostic) {
+    for _, d := range diags {
+        fmt.Fprintln(os.Stderr, d.String())
+    }
+    noun := "errors"
+    if len(diags) == 1 {
+        noun = "error"
+    }
+    fmt.Fprintf(os.Stderr, "%d %s found\n", len(diags), noun)
+}
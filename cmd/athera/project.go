@@ -0,0 +1,128 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+
+    "athera/internal/lang"
+    "athera/internal/project"
+)
+
+// loadProject reads the manifest of the project the current folder is in,
+// found there or in a folder above it, and makes sure each dependency is
+// installed in athera_modules and matches athera.lock, installing those
+// that are missing and recording new ones in the lockfile. It returns nil
+// outside a project, and exits if the manifest is invalid or an installed
+// dependency no longer matches the lockfile.
+func loadProject() *project.Manifest {
+    dir, err := project.FindManifest(".")
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    exitOnError(err)
+    m, err := project.LoadManifest(dir)
+    exitOnError(err)
+
+    lock := readLock(m.Dir)
+    before := lock.Format()
+    root := filepath.Join(m.Dir, lang.PackagesDir)
+    for _, dep := range m.Dependencies {
+        installed := filepath.Join(root, dep.Name)
+        locked := lock.Find(dep.Name)
+        if _, err := os.Stat(installed); err != nil || locked == nil || locked.Source != dep.Source {
+            _, err := project.Install(root, m.Dir, dep, lock)
+            exitOnError(err)
+            fmt.Printf("[Installed dependency: %s]\n", dep.Name)
+            continue
+        }
+        hash, err := project.HashDir(installed)
+        exitOnError(err)
+        if hash != locked.Hash {
+            fmt.Printf("Error: %s does not match %s; run `athera install` to reinstall it\n", filepath.Join(lang.PackagesDir, dep.Name), project.LockFile)
+            os.Exit(1)
+        }
+    }
+    if lock.Format() != before {
+        exitOnError(lock.Write(m.Dir))
+    }
+    return m
+}
+
+// runInstall installs the package given by a source into athera_modules,
+// recording it in athera.lock and, unless --no-save is given, in the
+// manifest. With no source it installs every dependency in the manifest.
+// Packages already in the lockfile must match their locked checksum.
+func runInstall(args []string) {
+    installFlags := flag.NewFlagSet("install", flag.ExitOnError)
+    name := installFlags.String("name", "", "install the package under this name")
+    noSave := installFlags.Bool("no-save", false, "do not add the package to athera.yaml")
+    installFlags.Parse(args)
+
+    m, err := project.LoadManifest(".")
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        exitOnError(err)
+    }
+    dir, err := filepath.Abs(".")
+    exitOnError(err)
+    if m != nil {
+        dir = m.Dir
+    }
+    root := filepath.Join(dir, lang.PackagesDir)
+    lock := readLock(dir)
+
+    source := installFlags.Arg(0)
+    if source == "" {
+        if m == nil {
+            fmt.Printf("Error: athera install requires a package source, or an %s in the current folder\n", project.ManifestFile)
+            os.Exit(1)
+        }
+        for _, dep := range m.Dependencies {
+            entry, err := project.Install(root, dir, dep, lock)
+            exitOnError(err)
+            fmt.Printf("✓ Installed %s (%s)\n", entry.Name, entry.Hash)
+        }
+        exitOnError(lock.Write(dir))
+        return
+    }
+
+    entry, err := project.Install(root, dir, project.Dependency{Name: *name, Source: source}, lock)
+    exitOnError(err)
+    exitOnError(lock.Write(dir))
+    if m != nil && !*noSave {
+        exitOnError(project.AddDependency(dir, project.Dependency{Name: entry.Name, Source: source}))
+    }
+    fmt.Printf("✓ Installed %s (%s)\n", entry.Name, entry.Hash)
+}
+
+// runLock writes athera.lock for the project in the current folder from
+// the dependencies' sources as they are now.
+func runLock() {
+    m, err := project.LoadManifest(".")
+    exitOnError(err)
+    lock, err := project.ResolveLock(m)
+    exitOnError(err)
+    exitOnError(lock.Write(m.Dir))
+    fmt.Printf("Locked %d dependencies in %s\n", len(lock.Dependencies), project.LockFile)
+}
+
+// readLock reads the lockfile in dir, or returns an empty one if there is
+// none yet.
+func readLock(dir string) *project.Lock {
+    lock, err := project.ReadLock(dir)
+    if errors.Is(err, fs.ErrNotExist) {
+        return &project.Lock{}
+    }
+    exitOnError(err)
+    return lock
+}
+
+func exitOnError(err error) {
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,161 @@
+// Package athera embeds the Athera language in Go programs. An Engine
+// compiles and runs Athera programs against output, input and globals the
+// host controls, and lets the host call the tasks a program defines:
+//
+//    engine := athera.NewEngine(athera.Options{Stdout: &out})
+//    prog, err := engine.Compile(`task double with n:
+//        return n * 2`)
+//    if err != nil {
+//        return err
+//    }
+//    if err := engine.Run(ctx, prog); err != nil {
+//        return err
+//    }
+//    result, err := engine.CallTask("double", 21)
+package athera
+
+import (
+    "context"
+    "io"
+    "os"
+
+    "athera/internal/lang"
+)
+
+// A Diagnostic is one syntax error found while compiling, with its
+// position in the source.
+type Diagnostic = lang.Diagnostic
+
+// A ParseError is returned by Compile for source with syntax errors; it
+// lists every error found.
+type ParseError = lang.ParseError
+
+// A RuntimeError is an error a program raised and did not handle, such as
+// a TaskNotFound or a TypeError. Its Kind is the name a `handle` clause
+// would match.
+type RuntimeError = lang.RuntimeError
+
+// Options configure an Engine. The zero value runs programs on the
+// bytecode VM with the default limits, writing to os.Stdout and os.Stderr
+// and reading from os.Stdin.
+type Options struct {
+    // Stdout and Stderr receive what programs write, by `greet` and by
+    // builtins such as io.print and io.warn.
+    Stdout io.Writer
+    Stderr io.Writer
+    // Stdin is what programs read, as by io.read_line.
+    Stdin io.Reader
+    // MaxCallDepth limits task recursion; zero means the default.
+    MaxCallDepth int
+    // MaxIterations limits the passes of a single loop; zero means the
+    // default.
+    MaxIterations int
+    // Lenient treats undefined variables as their own names, as older
+    // scripts that use bare words as strings expect.
+    Lenient bool
+    // TreeWalker runs programs on the tree-walking evaluator instead of
+    // the bytecode VM.
+    TreeWalker bool
+    // ModulePaths lists extra folders to search for modules that programs
+    // `use`.
+    ModulePaths []string
+}
+
+// An Engine runs Athera programs. Programs run on one Engine share its
+// globals and tasks, so a program can define tasks that a later one, or
+// the host through CallTask, calls. An Engine is not safe for concurrent
+// use; give each goroutine its own.
+type Engine struct {
+    interp *lang.Interpreter
+}
+
+// NewEngine creates an engine configured by opts.
+func NewEngine(opts Options) *Engine {
+    interp := lang.NewInterpreter()
+    stdout, stderr := opts.Stdout, opts.Stderr
+    if stdout == nil {
+        stdout = os.Stdout
+    }
+    if stderr == nil {
+        stderr = os.Stderr
+    }
+    interp.SetOutput(stdout, stderr)
+    if opts.Stdin != nil {
+        interp.SetInput(opts.Stdin)
+    }
+    if opts.MaxCallDepth > 0 {
+        interp.SetMaxCallDepth(opts.MaxCallDepth)
+    }
+    if opts.MaxIterations > 0 {
+        interp.SetMaxIterations(opts.MaxIterations)
+    }
+    interp.SetLenient(opts.Lenient)
+    interp.SetTreeWalker(opts.TreeWalker)
+    interp.SetModulePaths(opts.ModulePaths)
+    return &Engine{interp: interp}
+}
+
+// A Program is compiled Athera source, ready to run any number of times
+// on any Engine.
+type Program struct {
+    file string
+    prog *lang.Program
+}
+
+// Compile parses and compiles src. Source with syntax errors returns a
+// *ParseError.
+func (e *Engine) Compile(src string) (*Program, error) {
+    return compile("<source>", src)
+}
+
+// CompileFile reads, parses and compiles the program at path. When it
+// runs, errors are reported against path and the modules it uses are
+// searched for next to it.
+func (e *Engine) CompileFile(path string) (*Program, error) {
+    src, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return compile(path, string(src))
+}
+
+func compile(file, src string) (*Program, error) {
+    prog, diags := lang.Compile(file, src)
+    if len(diags) > 0 {
+        return nil, &ParseError{Diagnostics: diags}
+    }
+    return &Program{file: file, prog: prog}, nil
+}
+
+// Run runs a program until it finishes, raises an error it does not
+// handle, or ctx is canceled or passes its deadline. Errors are returned
+// as a *RuntimeError.
+func (e *Engine) Run(ctx context.Context, p *Program) error {
+    e.interp.SetContext(ctx)
+    defer e.interp.SetContext(context.Background())
+    e.interp.SetFile(p.file)
+    return e.interp.Run(p.prog)
+}
+
+// SetGlobal sets a top-level variable that programs can read. Go values
+// are converted to Athera values: integers of any size become int, floats
+// become float64, and slices and string-keyed maps become lists and
+// dicts.
+func (e *Engine) SetGlobal(name string, value any) {
+    e.interp.SetGlobal(name, value)
+}
+
+// GetGlobal returns the value of a top-level variable: nil, a bool, int,
+// float64 or string, a []any list or a map[string]any dict, or a task,
+// which can be passed back to programs.
+func (e *Engine) GetGlobal(name string) (any, bool) {
+    return e.interp.Global(name)
+}
+
+// CallTask calls a task defined by a program that has run, with args
+// converted as by SetGlobal, and returns what the task returned. The name
+// may be qualified by a module, as in "math_utils.square". An error raised
+// by the task is returned as a *RuntimeError.
+func (e *Engine) CallTask(name string, args ...any) (any, error) {
+    return e.interp.CallTask(name, args...)
+}
@@ -3,77 +3,304 @@ package lang
 // Node is the base interface for all AST nodes.
 type Node interface{}
 
-// TaskNode represents a task definition.
+// Pos records where a node starts in the source. It is embedded in every
+// statement node and every expression node; an operator expression starts
+// at its operator, and a call at its opening parenthesis. Column counts
+// runes from 1, as token columns do.
+type Pos struct {
+    Line   int
+    Column int
+}
+
+func (p Pos) line() int { return p.Line }
+
+func (p Pos) pos() Pos { return p }
+
+func (p *Pos) setPos(pos Pos) { *p = pos }
+
+// posOf returns the position of a token.
+func posOf(t Token) Pos {
+    return Pos{Line: t.Line, Column: t.Column}
+}
+
+// exprPos returns where an expression starts, or the zero Pos for nil.
+func exprPos(e Expr) Pos {
+    if positioned, ok := e.(interface{ pos() Pos }); ok {
+        return positioned.pos()
+    }
+    return Pos{}
+}
+
+// TaskNode represents a task definition. Returns is the annotated result
+// type, as in `task area with w: number, h: number -> number:`, or empty.
+// Exported marks `export task`, one that modules importing this file see.
 type TaskNode struct {
-    Name   string
-    Params []string
-    Body   []Node
+    Pos
+    Name     string
+    Params   []Param
+    Returns  string
+    Body     []Node
+    Exported bool
+}
+
+// Param is one parameter of a task. Default, when set, gives the value used
+// if the argument is left out; a Rest parameter (`...rest`) collects the
+// remaining positional arguments into a list. Type is the annotated type
+// name, or empty.
+type Param struct {
+    Name    string
+    Type    string
+    Default Expr
+    Rest    bool
 }
 
 // GreetNode prints a message.
 type GreetNode struct {
-    Message string
+    Pos
+    Message Expr
 }
 
 // BackupNode copies a file or folder to a destination.
 type BackupNode struct {
-    Source string
-    Dest   string
+    Pos
+    Source Expr
+    Dest   Expr
 }
 
 // CheckNode evaluates a condition then runs an inline action.
 type CheckNode struct {
-    Condition string
-    Action    string
+    Pos
+    Condition Expr
+    Action    Node
 }
 
-// RepeatNNode repeats a block a fixed number of times.
+// RepeatNNode repeats a block a computed number of times.
 type RepeatNNode struct {
-    Count int
+    Pos
+    Count Expr
     Body  []Node
 }
 
+// RepeatWhileNode repeats a block while its condition holds, or with Until
+// set, until it holds.
+type RepeatWhileNode struct {
+    Pos
+    Condition Expr
+    Until     bool
+    Body      []Node
+}
+
+// BreakNode leaves the innermost loop.
+type BreakNode struct {
+    Pos
+}
+
+// ContinueNode skips to the next iteration of the innermost loop.
+type ContinueNode struct {
+    Pos
+}
+
 // RepeatEachNode iterates over items in a list.
 type RepeatEachNode struct {
-    Var      string
-    ListExpr string
-    Body     []Node
+    Pos
+    Var  string
+    List Expr
+    Body []Node
 }
 
-// SetNode assigns the result of an expression to a variable.
+// SetNode assigns the result of an expression to a variable, or with
+// Target set, to a dict entry or list element reached from that variable
+// such as `d.key` or `xs[0]`. Type is the annotated type of the variable,
+// as in `set total: number = 0`, or empty.
 type SetNode struct {
-    Var   string
-    Value string
+    Pos
+    Var    string
+    Type   string
+    Target Expr
+    Value  Expr
 }
 
-// RunNode calls a named task with optional arguments.
+// RunNode calls a task with optional arguments. Task names either a task
+// or a variable holding a task value.
 type RunNode struct {
-    Target string
+    Pos
+    Task  string
+    Args  []Expr
+    Named []NamedArg
 }
 
-// UseNode imports a module.
+// NamedArg is an argument passed by parameter name, as in
+// `run greet_person name: "Ana"`. Its position is that of the name.
+type NamedArg struct {
+    Pos
+    Name  string
+    Value Expr
+}
+
+// UseNode imports a module. Alias renames it, as in `use math_utils as
+// mu`; Names imports just those tasks, as in `use square, add from
+// math_utils`.
 type UseNode struct {
+    Pos
     Module string
+    Alias  string
+    Names  []string
 }
 
-// ProtectNode represents a protect/handle block.
+// ProtectNode represents a protect block and its handle clauses, which are
+// *HandleBlockNode or *HandleInlineNode in source order.
 type ProtectNode struct {
-    Protect []Node
-    Handle  []Node
+    Pos
+    Protect  []Node
+    Handlers []Node
 }
 
-// HandleInlineNode runs when the preceding protect block fails.
+// HandleBlockNode is a `handle <Kind>:` clause. An empty ErrorType catches
+// every error.
+type HandleBlockNode struct {
+    Pos
+    ErrorType string
+    Body      []Node
+}
+
+// HandleInlineNode is a `handle <Kind> -> action` clause.
 type HandleInlineNode struct {
+    Pos
     ErrorType string
-    Action    string
+    Action    Node
+}
+
+// IfNode runs the body of the first branch whose condition holds, or Else
+// if none does.
+type IfNode struct {
+    Pos
+    Branches []IfBranch
+    Else     []Node
+}
+
+// IfBranch is the `if` or one `else if` part of an IfNode.
+type IfBranch struct {
+    Condition Expr
+    Body      []Node
+}
+
+// RaiseNode raises a user error of the given kind.
+type RaiseNode struct {
+    Pos
+    Kind    string
+    Message Expr
 }
 
 // RunParallelNode executes multiple tasks concurrently.
 type RunParallelNode struct {
+    Pos
     Tasks []string
 }
 
 // ReturnNode exits a task with a value.
 type ReturnNode struct {
-    Expr string
+    Pos
+    Value Expr
+}
+
+// GlobalNode declares that `set` on the listed names inside the current
+// task writes to global variables.
+type GlobalNode struct {
+    Pos
+    Names []string
+}
+
+// ExprNode evaluates an expression for its side effects, e.g. `io.write ...`.
+type ExprNode struct {
+    Pos
+    Expr Expr
+}
+
+// Expr is the base interface for all expression nodes.
+type Expr interface{}
+
+// LiteralExpr is a constant string, number or boolean.
+type LiteralExpr struct {
+    Pos
+    Value any
+}
+
+// InterpolatedExpr is a string with embedded `{expr}` parts. Parts holds
+// the literal text and expressions in order.
+type InterpolatedExpr struct {
+    Pos
+    Parts []Expr
+}
+
+// IdentExpr refers to a variable by name.
+type IdentExpr struct {
+    Pos
+    Name string
+}
+
+// ListExpr builds a list from its element expressions.
+type ListExpr struct {
+    Pos
+    Items []Expr
+}
+
+// DictExpr builds a dict from its keys and value expressions.
+type DictExpr struct {
+    Pos
+    Keys   []string
+    Values []Expr
+}
+
+// UnaryExpr applies a prefix operator such as `-` or `not`.
+type UnaryExpr struct {
+    Pos
+    Op      string
+    Operand Expr
+}
+
+// BinaryExpr applies an infix arithmetic, comparison or logical operator.
+type BinaryExpr struct {
+    Pos
+    Op    string
+    Left  Expr
+    Right Expr
+}
+
+// MemberExpr reads a property such as `items.length` or a module member.
+type MemberExpr struct {
+    Pos
+    Object Expr
+    Name   string
+}
+
+// IndexExpr reads an element such as `items[0]`.
+type IndexExpr struct {
+    Pos
+    Object Expr
+    Index  Expr
+}
+
+// LambdaExpr is an anonymous task such as `task with x -> x * 2`. Calling
+// it returns the value of Body.
+type LambdaExpr struct {
+    Pos
+    Params []Param
+    Body   Expr
+}
+
+// SliceExpr reads part of a list or string such as `items[1:3]`. A nil
+// Start or End means the beginning or end.
+type SliceExpr struct {
+    Pos
+    Object Expr
+    Start  Expr
+    End    Expr
+}
+
+// CallExpr invokes a function, either as `f(a, b)` or as `mod.fn a b`.
+type CallExpr struct {
+    Pos
+    Callee Expr
+    Args   []Expr
+    Named  []NamedArg
 }
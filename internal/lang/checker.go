@@ -0,0 +1,709 @@
+package lang
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// CheckFile reads and checks a program without running it; see CheckSource.
+func CheckFile(path string) ([]Diagnostic, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return CheckSource(path, string(data)), nil
+}
+
+// CheckSource checks a program without running it. It returns the syntax
+// errors if there are any, and otherwise every operator, builtin call, task
+// call, assignment and return whose types cannot match. Values the checker
+// cannot pin down, such as unannotated parameters, are never reported.
+func CheckSource(file, src string) []Diagnostic {
+    nodes, diags := ParseSource(file, src)
+    if len(diags) > 0 {
+        return diags
+    }
+    c := &checker{
+        file:    file,
+        lines:   strings.Split(src, "\n"),
+        tasks:   make(map[string]*TaskNode),
+        globals: make(map[string]typeSet),
+        seen:    make(map[string]bool),
+    }
+    c.checkProgram(nodes)
+    sort.SliceStable(c.diags, func(a, b int) bool {
+        da, db := c.diags[a], c.diags[b]
+        if da.Line != db.Line {
+            return da.Line < db.Line
+        }
+        return da.Column < db.Column
+    })
+    return c.diags
+}
+
+// checker infers types over a parsed program. Each variable has the type of
+// its latest assignment, widened where branches and loops join again, or
+// its annotated type if it has one.
+type checker struct {
+    file    string
+    lines   []string
+    tasks   map[string]*TaskNode
+    globals map[string]typeSet
+    env     *typeEnv
+    task    *TaskNode
+    at      Pos
+    quiet   int
+    seen    map[string]bool
+    diags   []Diagnostic
+}
+
+// typeEnv holds the variable types of one frame: the global scope, a task
+// call or an anonymous task.
+type typeEnv struct {
+    vars     map[string]typeSet
+    declared map[string]typeSet
+    globals  map[string]bool
+}
+
+func newTypeEnv() *typeEnv {
+    return &typeEnv{
+        vars:     make(map[string]typeSet),
+        declared: make(map[string]typeSet),
+        globals:  make(map[string]bool),
+    }
+}
+
+func (e *typeEnv) clone() *typeEnv {
+    out := newTypeEnv()
+    for k, t := range e.vars {
+        out.vars[k] = t
+    }
+    for k, t := range e.declared {
+        out.declared[k] = t
+    }
+    for k := range e.globals {
+        out.globals[k] = true
+    }
+    return out
+}
+
+// join widens e with the types in other, where two paths through the
+// program meet.
+func (e *typeEnv) join(other *typeEnv) {
+    for k, t := range other.vars {
+        e.vars[k] |= t
+    }
+    for k, t := range other.declared {
+        e.declared[k] = t
+    }
+    for k := range other.globals {
+        e.globals[k] = true
+    }
+}
+
+func (c *checker) checkProgram(nodes []Node) {
+    for _, n := range nodes {
+        switch node := n.(type) {
+        case *TaskNode:
+            c.tasks[node.Name] = node
+        case *SetNode:
+            if node.Type != "" {
+                c.globals[node.Var] = typeNames[node.Type]
+            }
+        }
+    }
+
+    c.env = newTypeEnv()
+    c.checkBlock(nodes)
+    for _, n := range nodes {
+        if task, ok := n.(*TaskNode); ok {
+            c.checkTask(task)
+        }
+    }
+}
+
+// checkTask checks a task body with its parameters typed by their
+// annotations.
+func (c *checker) checkTask(task *TaskNode) {
+    savedEnv, savedTask := c.env, c.task
+    c.env, c.task, c.at = newTypeEnv(), task, task.Pos
+    c.bindParams(task.Params)
+    c.checkBlock(task.Body)
+    c.env, c.task = savedEnv, savedTask
+}
+
+func (c *checker) bindParams(params []Param) {
+    for _, param := range params {
+        t := anyType
+        if param.Type != "" {
+            t = typeNames[param.Type]
+        }
+        if param.Default != nil {
+            if d := c.infer(param.Default); !d.fits(t) {
+                c.errorAt(exprPos(param.Default), "default of '%s' is %s, but it is declared as %s", param.Name, d, t)
+            }
+        }
+        if param.Rest {
+            c.env.vars[param.Name] = listType
+            continue
+        }
+        if param.Type != "" {
+            c.env.declared[param.Name] = t
+        }
+        c.env.vars[param.Name] = t
+    }
+}
+
+func (c *checker) checkBlock(nodes []Node) {
+    for _, n := range nodes {
+        c.checkNode(n)
+    }
+}
+
+func (c *checker) checkNode(n Node) {
+    if positioned, ok := n.(interface{ pos() Pos }); ok {
+        c.at = positioned.pos()
+    }
+
+    switch node := n.(type) {
+    case *GreetNode:
+        c.infer(node.Message)
+    case *BackupNode:
+        c.expect(node.Source, stringType, "backup source")
+        c.expect(node.Dest, stringType, "backup destination")
+    case *CheckNode:
+        c.infer(node.Condition)
+        start := c.env
+        c.env = start.clone()
+        c.checkNode(node.Action)
+        start.join(c.env)
+        c.env = start
+    case *IfNode:
+        start := c.env
+        var outcomes []*typeEnv
+        for _, branch := range node.Branches {
+            c.env = start
+            c.infer(branch.Condition)
+            c.env = start.clone()
+            c.checkBlock(branch.Body)
+            outcomes = append(outcomes, c.env)
+        }
+        c.env = start.clone()
+        c.checkBlock(node.Else)
+        for _, env := range outcomes {
+            c.env.join(env)
+        }
+    case *RepeatNNode:
+        c.expect(node.Count, numberType, "repeat count")
+        c.loop(node.Body, "")
+    case *RepeatWhileNode:
+        c.infer(node.Condition)
+        c.loop(node.Body, "")
+    case *RepeatEachNode:
+        c.expect(node.List, listType, "loop items")
+        c.loop(node.Body, node.Var)
+    case *SetNode:
+        value := c.infer(node.Value)
+        if node.Target != nil {
+            c.infer(node.Target)
+        } else {
+            c.assign(node.Var, node.Type, node.Value, value)
+        }
+    case *UseNode:
+        // A module file is bound as a dict of its tasks, which hides a
+        // stdlib module of the same name.
+        if _, builtin := StdlibModules[node.Module]; !builtin && node.Names == nil {
+            name := node.Alias
+            if name == "" {
+                name = node.Module
+            }
+            c.assign(name, "", nil, dictType)
+        }
+    case *RunNode:
+        args, named := c.inferArgs(node.Args, node.Named)
+        if t, ok := c.env.vars[node.Task]; ok {
+            c.callValue(nil, t)
+        } else if task, ok := c.tasks[node.Task]; ok {
+            c.checkTaskCall(task, Pos{}, args, named)
+        }
+    case *ProtectNode:
+        start := c.env.clone()
+        c.checkBlock(node.Protect)
+        outcomes := []*typeEnv{c.env}
+        for _, handler := range node.Handlers {
+            c.env = start.clone()
+            c.env.join(outcomes[0])
+            c.env.vars["error"] = errorType
+            switch h := handler.(type) {
+            case *HandleBlockNode:
+                c.at = h.Pos
+                c.checkBlock(h.Body)
+            case *HandleInlineNode:
+                c.checkNode(h.Action)
+            }
+            outcomes = append(outcomes, c.env)
+        }
+        c.env = outcomes[0]
+        for _, env := range outcomes[1:] {
+            c.env.join(env)
+        }
+    case *RaiseNode:
+        c.infer(node.Message)
+    case *ReturnNode:
+        t := c.infer(node.Value)
+        if c.task != nil && c.task.Returns != "" {
+            if want := typeNames[c.task.Returns]; !t.fits(want) {
+                c.errorAt(exprPos(node.Value), "task '%s' returns %s, but is declared to return %s", c.task.Name, t, want)
+            }
+        }
+    case *GlobalNode:
+        for _, name := range node.Names {
+            c.env.globals[name] = true
+        }
+    case *ExprNode:
+        c.infer(node.Expr)
+    }
+}
+
+// loop checks a loop body. It is walked once without reporting to learn
+// what its assignments carry into later passes, then again with the types
+// widened accordingly. The loop variable, if any, exists only in the body.
+func (c *checker) loop(body []Node, loopVar string) {
+    start := c.env.clone()
+    saved, hadVar := c.env.vars[loopVar]
+
+    c.quiet++
+    c.env.vars[loopVar] = anyType
+    c.checkBlock(body)
+    c.quiet--
+
+    c.env.join(start)
+    entry := c.env.clone()
+    c.env.vars[loopVar] = anyType
+    c.checkBlock(body)
+    c.env.join(entry)
+
+    if hadVar {
+        c.env.vars[loopVar] = saved
+    } else {
+        delete(c.env.vars, loopVar)
+    }
+}
+
+// assign records a `set`, checking the value, from expr, against the
+// variable's annotation if it has one.
+func (c *checker) assign(name, annotation string, expr Expr, value typeSet) {
+    if annotation != "" {
+        c.env.declared[name] = typeNames[annotation]
+    }
+    declared, ok := c.env.declared[name]
+    if c.env.globals[name] {
+        declared, ok = c.globals[name]
+    }
+    if ok {
+        if !value.fits(declared) {
+            c.errorAt(exprPos(expr), "cannot assign %s to '%s', which is declared as %s", value, name, declared)
+            value = declared
+        }
+        value &= declared
+    }
+    if !c.env.globals[name] {
+        c.env.vars[name] = value
+    }
+}
+
+func (c *checker) lookup(name string) typeSet {
+    if t, ok := c.env.vars[name]; ok && !c.env.globals[name] {
+        return t
+    }
+    if t, ok := c.globals[name]; ok && c.task != nil {
+        return t
+    }
+    if _, ok := c.tasks[name]; ok {
+        return taskType
+    }
+    return anyType
+}
+
+// expect infers expr and reports it unless it can be of type want.
+func (c *checker) expect(expr Expr, want typeSet, what string) typeSet {
+    t := c.infer(expr)
+    if !t.fits(want) {
+        c.errorAt(exprPos(expr), "%s must be %s, got %s", what, want, t)
+    }
+    return t
+}
+
+// infer returns the type of an expression, reporting any operation inside
+// it whose operand types cannot match.
+func (c *checker) infer(expr Expr) typeSet {
+    switch e := expr.(type) {
+    case nil:
+        return nullType
+    case *LiteralExpr:
+        return typeOfKind(kindOf(e.Value))
+    case *InterpolatedExpr:
+        for _, part := range e.Parts {
+            c.infer(part)
+        }
+        return stringType
+    case *IdentExpr:
+        return c.lookup(e.Name)
+    case *ListExpr:
+        for _, item := range e.Items {
+            c.infer(item)
+        }
+        return listType
+    case *DictExpr:
+        for _, value := range e.Values {
+            c.infer(value)
+        }
+        return dictType
+    case *UnaryExpr:
+        t := c.infer(e.Operand)
+        if e.Op == "not" {
+            return boolType
+        }
+        if !t.fits(numberType) {
+            c.errorAt(e.Pos, "cannot negate %s", t)
+            return numberType
+        }
+        return t & numberType
+    case *BinaryExpr:
+        return c.inferBinary(e)
+    case *MemberExpr:
+        if name, ok := c.builtinName(e); ok {
+            return c.checkBuiltin(name, e.Pos, nil, nil)
+        }
+        return c.inferMember(e, c.infer(e.Object))
+    case *IndexExpr:
+        obj := c.infer(e.Object)
+        c.infer(e.Index)
+        var out typeSet
+        if obj.has(StringValue) {
+            out |= stringType
+        }
+        if obj&(listType|dictType) != 0 {
+            out |= anyType
+        }
+        if out == noType {
+            c.errorAt(e.Pos, "cannot index %s", obj)
+            return anyType
+        }
+        return out
+    case *SliceExpr:
+        obj := c.infer(e.Object)
+        c.infer(e.Start)
+        c.infer(e.End)
+        if out := obj & (stringType | listType); out != noType {
+            return out
+        }
+        c.errorAt(e.Pos, "cannot slice %s", obj)
+        return stringType | listType
+    case *CallExpr:
+        return c.inferCall(e)
+    case *LambdaExpr:
+        saved := c.env
+        c.env = saved.clone()
+        c.bindParams(e.Params)
+        c.infer(e.Body)
+        c.env = saved
+        return taskType
+    }
+    return anyType
+}
+
+func (c *checker) inferBinary(e *BinaryExpr) typeSet {
+    left, right := c.infer(e.Left), c.infer(e.Right)
+    switch e.Op {
+    case "and", "or", "==", "!=":
+        return boolType
+    }
+
+    var out typeSet
+    for l := NullValue; l <= ErrorValue; l++ {
+        for r := NullValue; r <= ErrorValue; r++ {
+            if left.has(l) && right.has(r) {
+                out |= binaryResult(e.Op, l, r)
+            }
+        }
+    }
+    if out != noType {
+        return out
+    }
+    switch e.Op {
+    case "<", "<=", ">", ">=":
+        c.errorAt(e.Pos, "cannot compare %s and %s", left, right)
+        return boolType
+    }
+    c.errorAt(e.Pos, "unsupported operand types for %s: %s and %s", e.Op, left, right)
+    return anyType
+}
+
+// binaryResult follows binaryOp for one pair of operand kinds, returning
+// the type of the result, or noType if the operator rejects them.
+func binaryResult(op string, l, r ValueKind) typeSet {
+    lNum := l == IntValue || l == FloatValue
+    rNum := r == IntValue || r == FloatValue
+    switch op {
+    case "<", "<=", ">", ">=":
+        if (lNum && rNum) || (l == r && (l == StringValue || l == ListValue)) {
+            return boolType
+        }
+        return noType
+    case "+":
+        if l == StringValue || r == StringValue {
+            return stringType
+        }
+        if l == ListValue && r == ListValue {
+            return listType
+        }
+    }
+    switch {
+    case !lNum || !rNum:
+        return noType
+    case l == IntValue && r == IntValue && op == "/":
+        return numberType
+    case l == IntValue && r == IntValue:
+        return intType
+    }
+    return floatType
+}
+
+// inferMember follows memberOf for e, whose object is of type obj.
+func (c *checker) inferMember(e *MemberExpr, obj typeSet) typeSet {
+    name := e.Name
+    var out typeSet
+    if obj.has(DictValue) {
+        out |= anyType
+    }
+    if obj.has(ErrorValue) {
+        switch name {
+        case "message", "kind":
+            out |= stringType
+        case "line":
+            out |= intType
+        }
+    }
+    if obj&(stringType|listType) != noType {
+        switch name {
+        case "length":
+            out |= intType
+        case "is_empty":
+            out |= boolType
+        }
+    }
+    if out == noType {
+        c.errorAt(e.Pos, "%s has no property %s", obj, name)
+        return anyType
+    }
+    return out
+}
+
+func (c *checker) inferCall(call *CallExpr) typeSet {
+    args, named := c.inferArgs(call.Args, call.Named)
+    at := exprPos(call.Callee)
+    switch callee := call.Callee.(type) {
+    case *IdentExpr:
+        if t, ok := c.env.vars[callee.Name]; ok {
+            return c.callValue(callee, t)
+        }
+        if task, ok := c.tasks[callee.Name]; ok {
+            return c.checkTaskCall(task, at, args, named)
+        }
+        if _, ok := GlobalBuiltins[callee.Name]; ok {
+            return c.checkBuiltin(callee.Name, at, args, named)
+        }
+        return anyType
+    case *MemberExpr:
+        if name, ok := c.builtinName(callee); ok {
+            return c.checkBuiltin(name, at, args, named)
+        }
+    }
+    return c.callValue(call.Callee, c.infer(call.Callee))
+}
+
+// typedArg is a call argument with its inferred type. at is where the
+// argument is written, or for a named one where its name is.
+type typedArg struct {
+    at Pos
+    t  typeSet
+}
+
+func (c *checker) inferArgs(exprs []Expr, namedExprs []NamedArg) ([]typedArg, map[string]typedArg) {
+    args := make([]typedArg, 0, len(exprs))
+    for _, arg := range exprs {
+        args = append(args, typedArg{at: exprPos(arg), t: c.infer(arg)})
+    }
+    named := make(map[string]typedArg, len(namedExprs))
+    for _, arg := range namedExprs {
+        named[arg.Name] = typedArg{at: arg.Pos, t: c.infer(arg.Value)}
+    }
+    return args, named
+}
+
+// builtinName returns the qualified name of a stdlib function such as
+// `math.add`, unless the module name is a variable.
+func (c *checker) builtinName(member *MemberExpr) (string, bool) {
+    if !isModuleMember(member) {
+        return "", false
+    }
+    module := member.Object.(*IdentExpr).Name
+    if _, shadowed := c.env.vars[module]; shadowed {
+        return "", false
+    }
+    return module + "." + member.Name, true
+}
+
+// callValue checks a call of callee, a value of type t. callee is nil for
+// a `run` statement.
+func (c *checker) callValue(callee Expr, t typeSet) typeSet {
+    if !t.has(TaskValue) {
+        c.errorAt(exprPos(callee), "%s is not callable", t)
+    }
+    return anyType
+}
+
+// checkBuiltin checks a stdlib call against the function's signature and
+// returns its result type. at is where the function is named.
+func (c *checker) checkBuiltin(name string, at Pos, args []typedArg, named map[string]typedArg) typeSet {
+    sig, ok := signatures[name]
+    for _, key := range sortedArgKeys(named) {
+        want, declared := sig.named[key]
+        switch arg := named[key]; {
+        case !declared:
+            c.errorAt(arg.at, "%s has no parameter '%s'", name, key)
+        case !arg.t.fits(want):
+            c.errorAt(arg.at, "argument '%s' of %s must be %s, got %s", key, name, want, arg.t)
+        }
+    }
+    if !ok {
+        if module, fn, qualified := strings.Cut(name, "."); qualified {
+            if _, exists := StdlibModules[module][fn]; !exists {
+                c.errorAt(at, "unknown function %s", name)
+            }
+        }
+        return anyType
+    }
+
+    switch {
+    case len(args) < sig.required:
+        c.errorAt(at, "%s expects %s, got %d", name, countText(sig), len(args))
+    case !sig.variadic && len(args) > len(sig.params):
+        c.errorAt(args[len(sig.params)].at, "%s expects %s, got %d", name, countText(sig), len(args))
+    }
+    for idx, arg := range args {
+        pidx := idx
+        if pidx >= len(sig.params) {
+            if !sig.variadic {
+                break
+            }
+            pidx = len(sig.params) - 1
+        }
+        if want := sig.params[pidx]; !arg.t.fits(want) {
+            c.errorAt(arg.at, "argument %d of %s must be %s, got %s", idx+1, name, want, arg.t)
+        }
+    }
+    return sig.result
+}
+
+// countText describes how many arguments a signature takes.
+func countText(sig signature) string {
+    noun := func(n int) string {
+        if n == 1 {
+            return "1 argument"
+        }
+        return fmt.Sprintf("%d arguments", n)
+    }
+    switch {
+    case sig.variadic:
+        return "at least " + noun(sig.required)
+    case sig.required < len(sig.params):
+        return fmt.Sprintf("%d to %s", sig.required, noun(len(sig.params)))
+    }
+    return noun(sig.required)
+}
+
+// checkTaskCall checks a call's arguments against the task's parameters the
+// way bindArgs binds them, and returns the task's declared result type. at
+// is where the task is named, or the zero Pos for a `run` statement.
+func (c *checker) checkTaskCall(task *TaskNode, at Pos, args []typedArg, named map[string]typedArg) typeSet {
+    for _, key := range sortedArgKeys(named) {
+        if !hasParam(task.Params, key) {
+            c.errorAt(named[key].at, "task '%s' has no parameter '%s'", task.Name, key)
+        }
+    }
+
+    check := func(param Param, arg typedArg) {
+        if param.Type == "" {
+            return
+        }
+        if want := typeNames[param.Type]; !arg.t.fits(want) {
+            c.errorAt(arg.at, "argument '%s' of task '%s' must be %s, got %s", param.Name, task.Name, want, arg.t)
+        }
+    }
+    next := 0
+    for _, param := range task.Params {
+        arg, isNamed := named[param.Name]
+        switch {
+        case param.Rest:
+            for ; next < len(args); next++ {
+                check(param, args[next])
+            }
+        case next < len(args):
+            if isNamed {
+                c.errorAt(arg.at, "task '%s' got argument '%s' both by position and by name", task.Name, param.Name)
+            }
+            check(param, args[next])
+            next++
+        case isNamed:
+            check(param, arg)
+        case param.Default == nil:
+            c.errorAt(at, "task '%s' is missing argument '%s'", task.Name, param.Name)
+        }
+    }
+    if next < len(args) {
+        c.errorAt(args[next].at, "task '%s' takes %d positional arguments but %d were given", task.Name, next, len(args))
+    }
+
+    if task.Returns != "" {
+        return typeNames[task.Returns]
+    }
+    return anyType
+}
+
+func sortedArgKeys(m map[string]typedArg) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// errorAt reports a problem at the expression or token at, once. A zero
+// at stands for the statement being checked.
+func (c *checker) errorAt(at Pos, format string, args ...any) {
+    if c.quiet > 0 {
+        return
+    }
+    if at.Line == 0 {
+        at = c.at
+    }
+    msg := fmt.Sprintf(format, args...)
+    key := fmt.Sprintf("%d:%d:%s", at.Line, at.Column, msg)
+    if c.seen[key] {
+        return
+    }
+    c.seen[key] = true
+
+    c.diags = append(c.diags, Diagnostic{
+        File:    c.file,
+        Line:    at.Line,
+        Column:  at.Column,
+        Message: msg,
+        Excerpt: sourceExcerpt(c.lines, at.Line, at.Column),
+    })
+}
@@ -0,0 +1,33 @@
+package lang
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestCheckerColumns(t *testing.T) {
+    cases := []struct {
+        name, src, want string
+    }{
+        {"operator", "greet 1 - \"a\"", "1:9: unsupported operand types for -: int and string"},
+        {"after multibyte text", "greet \"ü\".length.foo", "1:18: int has no property foo"},
+        {"tab indentation", "task t -> int:\n\treturn \"x\"", "2:9: task 't' returns string, but is declared to return int"},
+        {"builtin argument", "greet math.add(1, \"two\")", "1:19: argument 2 of math.add must be number, got string"},
+        {"unknown function", "greet math.ad 1", "1:12: unknown function math.ad"},
+        {"named argument", "greet json.stringify({}, bad: 1)", "1:26: json.stringify has no parameter 'bad'"},
+        {"assignment", "set n: int = \"no\"", "1:14: cannot assign string to 'n', which is declared as int"},
+        {"interpolation", "greet \"é {1 - \"a\"}\"", "1:13: unsupported operand types for -: int and string"},
+        {"missing task argument", "task pair with a, b:\n    return a\ntask main:\n    run pair 1", "4:5: task 'pair' is missing argument 'b'"},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            diags := CheckSource("<source>", tc.src)
+            if len(diags) != 1 {
+                t.Fatalf("got %d diagnostics, want 1: %v", len(diags), diags)
+            }
+            if got := fmt.Sprintf("%d:%d: %s", diags[0].Line, diags[0].Column, diags[0].Message); got != tc.want {
+                t.Errorf("diagnostic = %q, want %q", got, tc.want)
+            }
+        })
+    }
+}
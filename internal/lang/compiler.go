@@ -0,0 +1,933 @@
+package lang
+
+// opcode is one VM instruction. Each takes up to three integer operands,
+// described next to it as a, b and c.
+type opcode uint8
+
+const (
+    opConst        opcode = iota // push consts[a]
+    opPop                        // drop the top value
+    opLine                       // record that line a is running
+    opLoadLocal                  // push slot a
+    opLoadCell                   // push the variable boxed in slot a
+    opLoadUpval                  // push captured variable a
+    opLoadGlobal                 // push the global named consts[a]
+    opStoreLocal                 // pop into slot a
+    opStoreCell                  // pop into the variable boxed in slot a
+    opStoreGlobal                // pop into the global named consts[a]
+    opBindCell                   // pop into a fresh box in slot a
+    opList                       // pop a values into a list
+    opDict                       // pop values into a dict with the keys consts[a]
+    opInterp                     // pop a values and join their text
+    opNeg                        // negate the top value
+    opNot                        // replace the top value with its negated truth
+    opTruthy                     // replace the top value with its truth
+    opBinary                     // pop two values and apply binaryOperators[a]
+    opMember                     // replace the top value with its property consts[a]
+    opModuleMember               // push the builtin member read described by consts[a]
+    opIndex                      // pop index and object, push the element
+    opSlice                      // pop the object, then end if a&2 and start if a&1
+    opSetMember                  // pop object and value, set property consts[a]
+    opSetIndex                   // pop index, object and value, set the element
+    opPathExists                 // replace the top value with whether it names a path
+    opJump                       // go to a
+    opJumpFalse                  // pop, go to a if falsy
+    opJumpTrue                   // pop, go to a if truthy
+    opRepeatCount                // check the top value is a whole repeat count
+    opForN                       // pass counter in slot a, count in a+1; exit to b; loop at line c
+    opIterate                    // count a pass in slot a for the loop at line b
+    opEachInit                   // check the top value is a list to repeat over
+    opForEach                    // list in slot a, index in a+1; push the next item or exit to b
+    opCallName                   // call the name in callSite consts[b] with a positional args
+    opCallModule                 // call the builtin in callSite consts[b]
+    opCallValue                  // pop a task value and call it per callSite consts[b]
+    opCallMember                 // pop an object and call its member per callSite consts[b]
+    opClosure                    // push an anonymous task running the code consts[a]
+    opDefineTask                 // define the task consts[a]
+    opReturn                     // pop the result and leave the frame
+    opGreet                      // pop and print
+    opBackup                     // pop destination and source, back up
+    opUse                        // import the module of consts[a]
+    opRaise                      // raise kind consts[a], with the popped message if b is 1
+    opParallel                   // run the parallelSite consts[a]
+    opProtect                    // run the protectSite consts[a]
+)
+
+// Operands of opBinary, indexing binaryOperators.
+const (
+    binAdd = iota
+    binSub
+    binMul
+    binDiv
+    binMod
+    binEq
+    binNe
+    binLt
+    binLe
+    binGt
+    binGe
+)
+
+// binaryOperators are the operators opBinary applies, by index.
+var binaryOperators = [...]string{"+", "-", "*", "/", "%", "==", "!=", "<", "<=", ">", ">="}
+
+// instr is a decoded instruction.
+type instr struct {
+    op      opcode
+    a, b, c int
+}
+
+// code is the bytecode for a program, task or anonymous task. Variables of
+// a task or anonymous task, and block variables such as loop variables,
+// live in numbered slots of its frame; variables at the top level of a
+// program are globals looked up by name. A slot whose variable anonymous
+// tasks may capture holds a *cell so that they share it.
+type code struct {
+    name       string
+    instrs     []instr
+    consts     []Value
+    slotNames  []string
+    cells      []bool
+    blockSpans map[int]span
+    params     []Param
+    paramSlots []int
+    defaults   []span
+    bodyStart  int
+    captures   []capture
+    upvalNames []string
+}
+
+// span is a range of instructions, such as a parameter default or the
+// block a block variable's slot belongs to.
+type span struct {
+    start, end int
+}
+
+// capture says where an anonymous task finds a variable it captures when
+// it is created: in a slot of the creating frame or among the creating
+// task's own captures.
+type capture struct {
+    fromUpval bool
+    index     int
+}
+
+// cell boxes a variable that anonymous tasks may capture.
+type cell struct {
+    v Value
+}
+
+// callSite describes a call: how the callee is found, the names of its
+// named arguments and the line it is made from.
+type callSite struct {
+    name      string
+    module    string
+    fn        BuiltinFunc
+    ref       varRef
+    named     []string
+    line      int
+    noBuiltin bool
+}
+
+// protectSite lays out a protect block: its body, then each handler.
+type protectSite struct {
+    body     span
+    handlers []handlerSite
+    end      int
+}
+
+type handlerSite struct {
+    kind string
+    span
+    slot int
+}
+
+// parallelSite is `run parallel` with the variables visible where it runs.
+type parallelSite struct {
+    node *RunParallelNode
+    refs []varRef
+}
+
+// taskProto is a task definition and its compiled body.
+type taskProto struct {
+    name     string
+    params   []Param
+    body     []Node
+    code     *code
+    exported bool
+}
+
+// varRef says where a variable name resolves.
+type varRef struct {
+    kind  varKind
+    index int
+    name  string
+}
+
+type varKind int
+
+const (
+    varGlobal varKind = iota
+    varLocal
+    varCell
+    varUpval
+)
+
+// compiler translates the AST of one program, task or anonymous task.
+type compiler struct {
+    code     *code
+    parent   *compiler
+    blocks   []map[string]int
+    frame    map[string]int
+    globals  map[string]bool
+    captured map[string]bool
+    loops    []*loopLabel
+}
+
+// loopLabel records where `continue` goes and the jumps `break` leaves
+// to be patched once the loop's end is known.
+type loopLabel struct {
+    top    int
+    breaks []int
+}
+
+// compileProgram compiles a whole program. Its top-level variables are
+// globals.
+func compileProgram(nodes []Node) *code {
+    c := &compiler{code: &code{name: "<main>"}, captured: capturedNames(nodes, nil)}
+    c.statements(nodes)
+    return c.code
+}
+
+// compileTask compiles a task body, or an anonymous task for which parent
+// is the compiler of the code creating it. Every variable set in the body
+// gets a slot up front, since `set` inside a block writes to the frame.
+func compileTask(name string, params []Param, body []Node, parent *compiler) *code {
+    c := &compiler{
+        code:     &code{name: name, params: params},
+        parent:   parent,
+        frame:    make(map[string]int),
+        globals:  make(map[string]bool),
+        captured: capturedNames(body, params),
+    }
+    collectGlobals(body, c.globals)
+    for _, param := range params {
+        c.frame[param.Name] = c.newSlot(param.Name)
+        c.code.paramSlots = append(c.code.paramSlots, c.frame[param.Name])
+    }
+    for _, name := range assignedNames(body) {
+        if _, ok := c.frame[name]; !ok && !c.globals[name] {
+            c.frame[name] = c.newSlot(name)
+        }
+    }
+    for _, param := range params {
+        var def span
+        if param.Default != nil {
+            def.start = len(c.code.instrs)
+            c.expr(param.Default)
+            def.end = len(c.code.instrs)
+        }
+        c.code.defaults = append(c.code.defaults, def)
+    }
+    c.code.bodyStart = len(c.code.instrs)
+    c.statements(body)
+    return c.code
+}
+
+func (c *compiler) emit(op opcode, operands ...int) int {
+    in := instr{op: op}
+    switch len(operands) {
+    case 3:
+        in.c = operands[2]
+        fallthrough
+    case 2:
+        in.b = operands[1]
+        fallthrough
+    case 1:
+        in.a = operands[0]
+    }
+    c.code.instrs = append(c.code.instrs, in)
+    return len(c.code.instrs) - 1
+}
+
+// patch points the jump at pc to the next instruction.
+func (c *compiler) patch(pc int) {
+    in := &c.code.instrs[pc]
+    if in.op == opForN || in.op == opForEach {
+        in.b = len(c.code.instrs)
+    } else {
+        in.a = len(c.code.instrs)
+    }
+}
+
+func (c *compiler) constant(v Value) int {
+    switch v.(type) {
+    case nil, bool, int, float64, string:
+        for idx, existing := range c.code.consts {
+            if existing == v {
+                return idx
+            }
+        }
+    }
+    c.code.consts = append(c.code.consts, v)
+    return len(c.code.consts) - 1
+}
+
+// newSlot adds a slot to the frame. Hidden slots, such as loop counters,
+// have no name.
+func (c *compiler) newSlot(name string) int {
+    c.code.slotNames = append(c.code.slotNames, name)
+    c.code.cells = append(c.code.cells, name != "" && c.captured[name])
+    return len(c.code.slotNames) - 1
+}
+
+// resolve finds what name refers to at this point of the code: a block
+// variable, a frame variable, a variable captured from an enclosing task,
+// or else a global.
+func (c *compiler) resolve(name string) varRef {
+    for b := len(c.blocks) - 1; b >= 0; b-- {
+        if slot, ok := c.blocks[b][name]; ok {
+            return c.code.slotRef(name, slot)
+        }
+    }
+    if c.globals[name] {
+        return varRef{kind: varGlobal, name: name}
+    }
+    if slot, ok := c.frame[name]; ok {
+        return c.code.slotRef(name, slot)
+    }
+    if c.parent != nil {
+        if idx, ok := c.upval(name); ok {
+            return varRef{kind: varUpval, index: idx, name: name}
+        }
+    }
+    return varRef{kind: varGlobal, name: name}
+}
+
+// upval returns the index of the captured variable name, adding it if the
+// enclosing code has such a variable.
+func (c *compiler) upval(name string) (int, bool) {
+    for idx, existing := range c.code.upvalNames {
+        if existing == name {
+            return idx, true
+        }
+    }
+    var cp capture
+    switch ref := c.parent.resolve(name); ref.kind {
+    case varCell:
+        cp = capture{index: ref.index}
+    case varUpval:
+        cp = capture{fromUpval: true, index: ref.index}
+    default:
+        return 0, false
+    }
+    c.code.captures = append(c.code.captures, cp)
+    c.code.upvalNames = append(c.code.upvalNames, name)
+    return len(c.code.upvalNames) - 1, true
+}
+
+func (c *compiler) load(name string) {
+    switch ref := c.resolve(name); ref.kind {
+    case varLocal:
+        c.emit(opLoadLocal, ref.index)
+    case varCell:
+        c.emit(opLoadCell, ref.index)
+    case varUpval:
+        c.emit(opLoadUpval, ref.index)
+    default:
+        c.emit(opLoadGlobal, c.constant(name))
+    }
+}
+
+func (c *compiler) store(name string) {
+    switch ref := c.resolve(name); ref.kind {
+    case varLocal:
+        c.emit(opStoreLocal, ref.index)
+    case varCell:
+        c.emit(opStoreCell, ref.index)
+    default:
+        c.emit(opStoreGlobal, c.constant(name))
+    }
+}
+
+// scoped compiles a block in a new block scope. With bind set, the value
+// on top of the stack becomes that block variable.
+func (c *compiler) scoped(body []Node, bind string) {
+    start := len(c.code.instrs)
+    c.blocks = append(c.blocks, make(map[string]int))
+    if bind != "" {
+        c.bind(bind)
+    }
+    c.statements(body)
+    c.endBlock(start)
+}
+
+// endBlock leaves the innermost block scope, which began at start,
+// recording where its variables' slots are live.
+func (c *compiler) endBlock(start int) {
+    if c.code.blockSpans == nil {
+        c.code.blockSpans = make(map[int]span)
+    }
+    for _, slot := range c.blocks[len(c.blocks)-1] {
+        c.code.blockSpans[slot] = span{start: start, end: len(c.code.instrs)}
+    }
+    c.blocks = c.blocks[:len(c.blocks)-1]
+}
+
+// bind defines a variable in the innermost block scope, taking its value
+// from the top of the stack. A captured one gets a fresh box each time, so
+// every loop pass has its own.
+func (c *compiler) bind(name string) int {
+    slot := c.newSlot(name)
+    c.blocks[len(c.blocks)-1][name] = slot
+    if c.code.cells[slot] {
+        c.emit(opBindCell, slot)
+    } else {
+        c.emit(opStoreLocal, slot)
+    }
+    return slot
+}
+
+func (c *compiler) statements(nodes []Node) {
+    for _, n := range nodes {
+        c.statement(n)
+    }
+}
+
+func (c *compiler) statement(n Node) {
+    if positioned, ok := n.(interface{ line() int }); ok {
+        c.emit(opLine, positioned.line())
+    }
+
+    switch node := n.(type) {
+    case *TaskNode:
+        proto := &taskProto{name: node.Name, params: node.Params, body: node.Body, exported: node.Exported}
+        proto.code = compileTask(node.Name, node.Params, node.Body, nil)
+        c.emit(opDefineTask, c.constant(proto))
+    case *GreetNode:
+        c.expr(node.Message)
+        c.emit(opGreet)
+    case *BackupNode:
+        c.expr(node.Source)
+        c.expr(node.Dest)
+        c.emit(opBackup)
+    case *CheckNode:
+        if node.Action != nil {
+            c.condition(node.Condition)
+            skip := c.emit(opJumpFalse, -1)
+            c.statement(node.Action)
+            c.patch(skip)
+        }
+    case *IfNode:
+        var ends []int
+        for _, branch := range node.Branches {
+            c.condition(branch.Condition)
+            next := c.emit(opJumpFalse, -1)
+            c.scoped(branch.Body, "")
+            ends = append(ends, c.emit(opJump, -1))
+            c.patch(next)
+        }
+        if node.Else != nil {
+            c.scoped(node.Else, "")
+        }
+        for _, end := range ends {
+            c.patch(end)
+        }
+    case *RepeatNNode:
+        c.expr(node.Count)
+        c.emit(opRepeatCount)
+        counter := c.newSlot("")
+        c.newSlot("")
+        c.emit(opStoreLocal, counter+1)
+        c.emit(opConst, c.constant(0))
+        c.emit(opStoreLocal, counter)
+        loop := c.beginLoop()
+        exit := c.emit(opForN, counter, -1, node.Line)
+        c.scoped(node.Body, "")
+        c.endLoop(loop, exit)
+    case *RepeatWhileNode:
+        counter := c.newSlot("")
+        c.emit(opConst, c.constant(0))
+        c.emit(opStoreLocal, counter)
+        loop := c.beginLoop()
+        c.condition(node.Condition)
+        exit := c.emit(opJumpFalse, -1)
+        if node.Until {
+            c.code.instrs[exit].op = opJumpTrue
+        }
+        c.emit(opIterate, counter, node.Line)
+        c.scoped(node.Body, "")
+        c.endLoop(loop, exit)
+    case *RepeatEachNode:
+        c.expr(node.List)
+        c.emit(opEachInit)
+        items := c.newSlot("")
+        c.newSlot("")
+        c.emit(opStoreLocal, items)
+        c.emit(opConst, c.constant(0))
+        c.emit(opStoreLocal, items+1)
+        loop := c.beginLoop()
+        exit := c.emit(opForEach, items, -1)
+        c.scoped(node.Body, node.Var)
+        c.endLoop(loop, exit)
+    case *BreakNode:
+        if len(c.loops) == 0 {
+            c.emitReturn(nil)
+            break
+        }
+        loop := c.loops[len(c.loops)-1]
+        loop.breaks = append(loop.breaks, c.emit(opJump, -1))
+    case *ContinueNode:
+        if len(c.loops) == 0 {
+            c.emitReturn(nil)
+            break
+        }
+        c.emit(opJump, c.loops[len(c.loops)-1].top)
+    case *SetNode:
+        c.expr(node.Value)
+        switch t := node.Target.(type) {
+        case nil:
+            c.store(node.Var)
+        case *MemberExpr:
+            c.expr(t.Object)
+            c.emit(opSetMember, c.constant(t.Name))
+        case *IndexExpr:
+            c.expr(t.Object)
+            c.expr(t.Index)
+            c.emit(opSetIndex)
+        }
+    case *RunNode:
+        site := c.args(node.Args, node.Named, node.Line)
+        site.name, site.ref, site.noBuiltin = node.Task, c.resolve(node.Task), true
+        c.emit(opCallName, len(node.Args), c.constant(site))
+        c.emit(opPop)
+    case *UseNode:
+        c.emit(opUse, c.constant(node))
+    case *ProtectNode:
+        c.protect(node)
+    case *RaiseNode:
+        hasMessage := 0
+        if node.Message != nil {
+            c.expr(node.Message)
+            hasMessage = 1
+        }
+        c.emit(opRaise, c.constant(node.Kind), hasMessage)
+    case *RunParallelNode:
+        site := &parallelSite{node: node}
+        for _, name := range sortedKeys(c.frameVars()) {
+            site.refs = append(site.refs, c.resolve(name))
+        }
+        c.emit(opParallel, c.constant(site))
+    case *ReturnNode:
+        c.emitReturn(node.Value)
+    case *ExprNode:
+        c.expr(node.Expr)
+        c.emit(opPop)
+    }
+}
+
+func (c *compiler) emitReturn(value Expr) {
+    c.expr(value)
+    c.emit(opReturn)
+}
+
+// frameVars lists the slot variables visible at this point of the code.
+func (c *compiler) frameVars() map[string]Value {
+    names := make(map[string]Value)
+    for name := range c.frame {
+        names[name] = nil
+    }
+    for _, block := range c.blocks {
+        for name := range block {
+            names[name] = nil
+        }
+    }
+    return names
+}
+
+func (c *compiler) beginLoop() *loopLabel {
+    loop := &loopLabel{top: len(c.code.instrs)}
+    c.loops = append(c.loops, loop)
+    return loop
+}
+
+// endLoop closes a loop body: it jumps back to the top and points exit and
+// every `break` past the loop.
+func (c *compiler) endLoop(loop *loopLabel, exit int) {
+    c.emit(opJump, loop.top)
+    c.patch(exit)
+    for _, pc := range loop.breaks {
+        c.patch(pc)
+    }
+    c.loops = c.loops[:len(c.loops)-1]
+}
+
+// condition compiles the condition of `check`, `if` or a loop, where a
+// quoted string or template tests whether that path exists.
+func (c *compiler) condition(expr Expr) {
+    switch e := expr.(type) {
+    case *LiteralExpr:
+        if _, isStr := e.Value.(string); isStr {
+            c.expr(e)
+            c.emit(opPathExists)
+            return
+        }
+    case *InterpolatedExpr:
+        c.expr(e)
+        c.emit(opPathExists)
+        return
+    }
+    c.expr(expr)
+}
+
+// protect lays out a protect block as its body followed by each handler.
+// The VM runs the body under a recover and on an error jumps to the first
+// handler matching its kind, with `error` bound in a block scope.
+func (c *compiler) protect(node *ProtectNode) {
+    site := &protectSite{}
+    c.emit(opProtect, c.constant(site))
+    site.body.start = len(c.code.instrs)
+    c.statements(node.Protect)
+    site.body.end = len(c.code.instrs)
+    for _, h := range node.Handlers {
+        var kind string
+        var body []Node
+        switch clause := h.(type) {
+        case *HandleBlockNode:
+            kind, body = clause.ErrorType, clause.Body
+        case *HandleInlineNode:
+            kind = clause.ErrorType
+            if clause.Action != nil {
+                body = []Node{clause.Action}
+            }
+        }
+        c.blocks = append(c.blocks, make(map[string]int))
+        handler := handlerSite{kind: kind, slot: c.newSlot("error")}
+        c.blocks[len(c.blocks)-1]["error"] = handler.slot
+        handler.start = len(c.code.instrs)
+        c.statements(body)
+        handler.end = len(c.code.instrs)
+        c.endBlock(handler.start)
+        site.handlers = append(site.handlers, handler)
+    }
+    site.end = len(c.code.instrs)
+}
+
+// args compiles the arguments of a call, positional then named, and
+// returns a call site for the rest of the call to fill in.
+func (c *compiler) args(exprs []Expr, named []NamedArg, line int) *callSite {
+    for _, arg := range exprs {
+        c.expr(arg)
+    }
+    site := &callSite{line: line}
+    for _, arg := range named {
+        c.expr(arg.Value)
+        site.named = append(site.named, arg.Name)
+    }
+    return site
+}
+
+func (c *compiler) expr(expr Expr) {
+    switch e := expr.(type) {
+    case nil:
+        c.emit(opConst, c.constant(nil))
+    case *LiteralExpr:
+        c.emit(opConst, c.constant(e.Value))
+    case *InterpolatedExpr:
+        for _, part := range e.Parts {
+            c.expr(part)
+        }
+        c.emit(opInterp, len(e.Parts))
+    case *IdentExpr:
+        c.load(e.Name)
+    case *ListExpr:
+        for _, item := range e.Items {
+            c.expr(item)
+        }
+        c.emit(opList, len(e.Items))
+    case *DictExpr:
+        for _, value := range e.Values {
+            c.expr(value)
+        }
+        c.emit(opDict, c.constant(e.Keys))
+    case *UnaryExpr:
+        c.expr(e.Operand)
+        if e.Op == "not" {
+            c.emit(opNot)
+        } else {
+            c.emit(opNeg)
+        }
+    case *BinaryExpr:
+        c.binary(e)
+    case *MemberExpr:
+        if site := c.moduleSite(e); site != nil && site.fn != nil {
+            c.emit(opModuleMember, c.constant(site))
+            return
+        }
+        c.expr(e.Object)
+        c.emit(opMember, c.constant(e.Name))
+    case *IndexExpr:
+        c.expr(e.Object)
+        c.expr(e.Index)
+        c.emit(opIndex)
+    case *SliceExpr:
+        flags := 0
+        if e.Start != nil {
+            c.expr(e.Start)
+            flags |= 1
+        }
+        if e.End != nil {
+            c.expr(e.End)
+            flags |= 2
+        }
+        c.expr(e.Object)
+        c.emit(opSlice, flags)
+    case *CallExpr:
+        c.call(e)
+    case *LambdaExpr:
+        body := &ReturnNode{Pos: e.Pos, Value: e.Body}
+        lambda := compileTask("lambda", e.Params, []Node{body}, c)
+        c.emit(opClosure, c.constant(lambda))
+    }
+}
+
+func (c *compiler) binary(e *BinaryExpr) {
+    c.expr(e.Left)
+    switch e.Op {
+    case "and", "or":
+        jump, short := opJumpFalse, false
+        if e.Op == "or" {
+            jump, short = opJumpTrue, true
+        }
+        skip := c.emit(jump, -1)
+        c.expr(e.Right)
+        c.emit(opTruthy)
+        end := c.emit(opJump, -1)
+        c.patch(skip)
+        c.emit(opConst, c.constant(short))
+        c.patch(end)
+        return
+    }
+    c.expr(e.Right)
+    for idx, op := range binaryOperators {
+        if op == e.Op {
+            c.emit(opBinary, idx)
+            return
+        }
+    }
+}
+
+// moduleSite describes `module.fn` when module names a stdlib module. The
+// VM still checks at run time that no variable shadows the module.
+func (c *compiler) moduleSite(member *MemberExpr) *callSite {
+    ident, ok := member.Object.(*IdentExpr)
+    if !ok {
+        return nil
+    }
+    funcs, ok := StdlibModules[ident.Name]
+    if !ok {
+        return nil
+    }
+    return &callSite{name: member.Name, module: ident.Name, fn: funcs[member.Name], ref: c.resolve(ident.Name)}
+}
+
+// call compiles a call. A plain name is resolved when the call runs, as a
+// variable holding a task, a global builtin or a task; `module.fn` calls a
+// builtin; `name.member` calls the member of the variable name; anything
+// else must evaluate to a task value.
+func (c *compiler) call(e *CallExpr) {
+    site := c.args(e.Args, e.Named, e.Line)
+    switch callee := e.Callee.(type) {
+    case *IdentExpr:
+        site.name, site.ref = callee.Name, c.resolve(callee.Name)
+        c.emit(opCallName, len(e.Args), c.constant(site))
+        return
+    case *MemberExpr:
+        if module := c.moduleSite(callee); module != nil {
+            site.name, site.module, site.fn, site.ref = module.name, module.module, module.fn, module.ref
+            c.emit(opCallModule, len(e.Args), c.constant(site))
+            return
+        }
+        if ident, ok := callee.Object.(*IdentExpr); ok {
+            site.name, site.module = callee.Name, ident.Name
+            c.expr(ident)
+            c.emit(opCallMember, len(e.Args), c.constant(site))
+            return
+        }
+    }
+    c.expr(e.Callee)
+    c.emit(opCallValue, len(e.Args), c.constant(site))
+}
+
+// capturedNames lists the names used inside anonymous tasks in nodes, or
+// in the defaults of params. A variable with one of these names may be
+// captured, so the compiler boxes it.
+func capturedNames(nodes []Node, params []Param) map[string]bool {
+    names := make(map[string]bool)
+    var inLambda func(Expr)
+    inLambda = func(e Expr) {
+        walkExpr(e, func(e Expr) {
+            if ident, ok := e.(*IdentExpr); ok {
+                names[ident.Name] = true
+            }
+        })
+    }
+    visit := func(e Expr) {
+        walkExpr(e, func(e Expr) {
+            if lambda, ok := e.(*LambdaExpr); ok {
+                inLambda(lambda)
+            }
+        })
+    }
+    for _, param := range params {
+        visit(param.Default)
+    }
+    walkNodes(nodes, visit)
+    return names
+}
+
+// assignedNames lists every variable name `set` assigns in nodes, not
+// counting nested task definitions.
+func assignedNames(nodes []Node) []string {
+    var names []string
+    walkStatements(nodes, func(n Node) {
+        if node, ok := n.(*SetNode); ok && node.Target == nil {
+            names = append(names, node.Var)
+        }
+    })
+    return names
+}
+
+// collectGlobals records the names a task body declares `global`.
+func collectGlobals(nodes []Node, globals map[string]bool) {
+    walkStatements(nodes, func(n Node) {
+        if node, ok := n.(*GlobalNode); ok {
+            for _, name := range node.Names {
+                globals[name] = true
+            }
+        }
+    })
+}
+
+// walkStatements calls fn for every statement in nodes and the blocks
+// nested in them, not counting nested task definitions.
+func walkStatements(nodes []Node, fn func(Node)) {
+    for _, n := range nodes {
+        if n == nil {
+            continue
+        }
+        fn(n)
+        switch node := n.(type) {
+        case *CheckNode:
+            walkStatements([]Node{node.Action}, fn)
+        case *IfNode:
+            for _, branch := range node.Branches {
+                walkStatements(branch.Body, fn)
+            }
+            walkStatements(node.Else, fn)
+        case *RepeatNNode:
+            walkStatements(node.Body, fn)
+        case *RepeatWhileNode:
+            walkStatements(node.Body, fn)
+        case *RepeatEachNode:
+            walkStatements(node.Body, fn)
+        case *ProtectNode:
+            walkStatements(node.Protect, fn)
+            walkStatements(node.Handlers, fn)
+        case *HandleBlockNode:
+            walkStatements(node.Body, fn)
+        case *HandleInlineNode:
+            walkStatements([]Node{node.Action}, fn)
+        }
+    }
+}
+
+// walkNodes calls fn for each expression directly in the statements of
+// nodes and their nested blocks.
+func walkNodes(nodes []Node, fn func(Expr)) {
+    walkStatements(nodes, func(n Node) {
+        switch node := n.(type) {
+        case *GreetNode:
+            fn(node.Message)
+        case *BackupNode:
+            fn(node.Source)
+            fn(node.Dest)
+        case *CheckNode:
+            fn(node.Condition)
+        case *IfNode:
+            for _, branch := range node.Branches {
+                fn(branch.Condition)
+            }
+        case *RepeatNNode:
+            fn(node.Count)
+        case *RepeatWhileNode:
+            fn(node.Condition)
+        case *RepeatEachNode:
+            fn(node.List)
+        case *SetNode:
+            fn(node.Target)
+            fn(node.Value)
+        case *RunNode:
+            for _, arg := range node.Args {
+                fn(arg)
+            }
+            for _, arg := range node.Named {
+                fn(arg.Value)
+            }
+        case *RaiseNode:
+            fn(node.Message)
+        case *ReturnNode:
+            fn(node.Value)
+        case *ExprNode:
+            fn(node.Expr)
+        }
+    })
+}
+
+// walkExpr calls fn for e and every expression nested in it.
+func walkExpr(e Expr, fn func(Expr)) {
+    if e == nil {
+        return
+    }
+    fn(e)
+    switch e := e.(type) {
+    case *InterpolatedExpr:
+        for _, part := range e.Parts {
+            walkExpr(part, fn)
+        }
+    case *ListExpr:
+        for _, item := range e.Items {
+            walkExpr(item, fn)
+        }
+    case *DictExpr:
+        for _, value := range e.Values {
+            walkExpr(value, fn)
+        }
+    case *UnaryExpr:
+        walkExpr(e.Operand, fn)
+    case *BinaryExpr:
+        walkExpr(e.Left, fn)
+        walkExpr(e.Right, fn)
+    case *MemberExpr:
+        walkExpr(e.Object, fn)
+    case *IndexExpr:
+        walkExpr(e.Object, fn)
+        walkExpr(e.Index, fn)
+    case *SliceExpr:
+        walkExpr(e.Object, fn)
+        walkExpr(e.Start, fn)
+        walkExpr(e.End, fn)
+    case *CallExpr:
+        walkExpr(e.Callee, fn)
+        for _, arg := range e.Args {
+            walkExpr(arg, fn)
+        }
+        for _, arg := range e.Named {
+            walkExpr(arg.Value, fn)
+        }
+    case *LambdaExpr:
+        for _, param := range e.Params {
+            walkExpr(param.Default, fn)
+        }
+        walkExpr(e.Body, fn)
+    }
+}
@@ -0,0 +1,115 @@
+package lang
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Diagnostic describes a problem found in a source file.
+type Diagnostic struct {
+    File    string
+    Line    int
+    Column  int
+    Message string
+    Excerpt string
+}
+
+// String formats the diagnostic as `file:line:col: message` followed by the
+// caret-annotated source excerpt.
+func (d Diagnostic) String() string {
+    header := fmt.Sprintf("%s:%d:%d: error: %s", d.File, d.Line, d.Column, d.Message)
+    if d.Excerpt == "" {
+        return header
+    }
+    return header + "\n" + d.Excerpt
+}
+
+// ParseError is returned when a program has syntax errors and was not run.
+type ParseError struct {
+    Diagnostics []Diagnostic
+}
+
+func (e *ParseError) Error() string {
+    parts := make([]string, 0, len(e.Diagnostics))
+    for _, d := range e.Diagnostics {
+        parts = append(parts, d.String())
+    }
+    return strings.Join(parts, "\n")
+}
+
+// sourceExcerpt renders a source line with a caret under the given column.
+func sourceExcerpt(lines []string, line, column int) string {
+    if line < 1 || line > len(lines) {
+        return ""
+    }
+    text := strings.TrimRight(lines[line-1], "\r")
+    gutter := fmt.Sprintf("%4d | ", line)
+
+    var pad strings.Builder
+    for idx, r := range []rune(text) {
+        if idx >= column-1 {
+            break
+        }
+        if r == '\t' {
+            pad.WriteRune('\t')
+        } else {
+            pad.WriteRune(' ')
+        }
+    }
+    return gutter + text + "\n" + strings.Repeat(" ", len(gutter)-2) + "| " + pad.String() + "^"
+}
+
+// describeToken names a token the way it should read in an error message.
+func describeToken(t Token) string {
+    switch t.Type {
+    case "NEWLINE":
+        return "end of line"
+    case "EOF":
+        return "end of file"
+    case "STRING":
+        return fmt.Sprintf("string %q", t.Value)
+    case "NUMBER":
+        return "number " + t.Value
+    case "IDENT":
+        return fmt.Sprintf("name %q", t.Value)
+    case "KEYWORD":
+        return fmt.Sprintf("keyword %q", t.Value)
+    case "INDENT":
+        return "indentation"
+    }
+    return fmt.Sprintf("%q", t.Value)
+}
+
+// suggestKeyword returns the statement keyword closest to word, if any is
+// within two edits. Keywords equally close are broken by name, so the
+// same word always gets the same suggestion.
+func suggestKeyword(word string) string {
+    best, bestDist := "", 3
+    for kw := range statementKeywords {
+        if d := editDistance(word, kw); d < bestDist || (d == bestDist && kw < best) {
+            best, bestDist = kw, d
+        }
+    }
+    return best
+}
+
+func editDistance(a, b string) int {
+    ra, rb := []rune(a), []rune(b)
+    prev := make([]int, len(rb)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(ra); i++ {
+        cur := make([]int, len(rb)+1)
+        cur[0] = i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+        }
+        prev = cur
+    }
+    return prev[len(rb)]
+}
@@ -0,0 +1,165 @@
+package lang
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+)
+
+// Error kinds raised by the runtime. Scripts see them as `error.kind` and
+// name them in `handle <Kind>` clauses.
+const (
+    KindRuntime          = "RuntimeError"
+    KindIO               = "IOError"
+    KindFileNotFound     = "FileNotFound"
+    KindPermissionDenied = "PermissionDenied"
+    KindType             = "TypeError"
+    KindArgument         = "ArgumentError"
+    KindDivisionByZero   = "DivisionByZero"
+    KindIndex            = "IndexError"
+    KindTimeout          = "Timeout"
+    KindTaskNotFound     = "TaskNotFound"
+    KindRecursion        = "RecursionError"
+    KindIterationLimit   = "IterationLimit"
+    KindUndefined        = "UndefinedVariable"
+    KindImport           = "ImportError"
+    KindUser             = "UserError"
+)
+
+// kindParents lets a handler for a general kind catch its specific kinds,
+// e.g. `handle IOError` also catches FileNotFound.
+var kindParents = map[string]string{
+    KindFileNotFound:     KindIO,
+    KindPermissionDenied: KindIO,
+}
+
+// kindMatches reports whether an error of kind is caught by a handler for
+// want. An empty want is a catch-all.
+func kindMatches(kind, want string) bool {
+    for want != "" && kind != "" {
+        if kind == want {
+            return true
+        }
+        kind = kindParents[kind]
+    }
+    return want == ""
+}
+
+// RuntimeError is raised when a statement fails during execution. It
+// unwinds to the nearest protect block, or ends the program if there is none.
+// Line is zero for errors raised outside any statement, as by a task the
+// host calls that does not exist.
+type RuntimeError struct {
+    Kind    string
+    Message string
+    File    string
+    Line    int
+    Stack   []StackFrame
+}
+
+func (e *RuntimeError) Error() string {
+    var loc string
+    switch {
+    case e.Line == 0:
+        loc = e.File
+    case e.File != "":
+        loc = fmt.Sprintf("%s:%d", e.File, e.Line)
+    default:
+        loc = fmt.Sprintf("line %d", e.Line)
+    }
+    msg := fmt.Sprintf("%s: %s", e.Kind, e.Message)
+    if loc != "" {
+        msg = loc + ": " + msg
+    }
+    if trace := formatStack(e.Stack); trace != "" {
+        msg += "\n" + trace
+    }
+    return msg
+}
+
+// kindError is a Go error that already knows which error kind it maps to.
+type kindError struct {
+    kind string
+    msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+// argError reports that a builtin was called with missing or ill-typed
+// arguments.
+func argError(format string, args ...any) error {
+    return &kindError{kind: KindArgument, msg: fmt.Sprintf(format, args...)}
+}
+
+// typeError reports an operation applied to values of the wrong type.
+func typeError(format string, args ...any) error {
+    return &kindError{kind: KindType, msg: fmt.Sprintf(format, args...)}
+}
+
+// indexError reports an index outside a list or string.
+func indexError(format string, args ...any) error {
+    return &kindError{kind: KindIndex, msg: fmt.Sprintf(format, args...)}
+}
+
+var errDivisionByZero = &kindError{kind: KindDivisionByZero, msg: "division by zero"}
+
+// errorKind classifies a Go error returned by a builtin or operator.
+func errorKind(err error) string {
+    var kindErr *kindError
+    var pathErr *fs.PathError
+    switch {
+    case errors.As(err, &kindErr):
+        return kindErr.kind
+    case errors.Is(err, fs.ErrNotExist):
+        return KindFileNotFound
+    case errors.Is(err, fs.ErrPermission):
+        return KindPermissionDenied
+    case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+        return KindTimeout
+    case errors.As(err, &pathErr):
+        return KindIO
+    }
+    return KindRuntime
+}
+
+// raise aborts the current statement with a runtime error at the line
+// being executed.
+func (i *Interpreter) raise(kind, format string, args ...any) {
+    panic(i.newError(kind, fmt.Sprintf(format, args...)))
+}
+
+func (i *Interpreter) newError(kind, message string) *RuntimeError {
+    stack := make([]StackFrame, len(i.callStack))
+    copy(stack, i.callStack)
+    return &RuntimeError{Kind: kind, Message: message, File: i.file, Line: i.line, Stack: stack}
+}
+
+// raiseUndefined reports a read of a variable that was never set, hinting
+// at one of the visible variables it may be a misspelling of, other than
+// the name itself.
+func (i *Interpreter) raiseUndefined(name string, visible map[string]Value) {
+    best, bestDist := "", 3
+    for candidate := range visible {
+        d := editDistance(name, candidate)
+        if candidate != name && d < len(name) && (d < bestDist || (d == bestDist && candidate < best)) {
+            best, bestDist = candidate, d
+        }
+    }
+    if best != "" {
+        i.raise(KindUndefined, "undefined variable '%s' (did you mean '%s'?)", name, best)
+    }
+    i.raise(KindUndefined, "undefined variable '%s'", name)
+}
+
+// asRuntimeError converts a recovered panic value into a RuntimeError.
+func (i *Interpreter) asRuntimeError(r any) *RuntimeError {
+    if rtErr, ok := r.(*RuntimeError); ok {
+        return rtErr
+    }
+    if err, ok := r.(error); ok {
+        return i.newError(errorKind(err), err.Error())
+    }
+    return i.newError(KindRuntime, fmt.Sprint(r))
+}
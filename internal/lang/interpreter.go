@@ -1,581 +1,923 @@
 package lang
 
 import (
+    "bufio"
+    "context"
+    "errors"
     "fmt"
     "io"
     "os"
     "path/filepath"
-    "strconv"
     "strings"
     "sync"
+    "time"
 )
 
 // Interpreter executes Athera programs.
 type Interpreter struct {
     tasks         map[string]TaskDef
-    variables     map[string]any
+    globals       *scope
+    current       *scope
+    callStack     []StackFrame
+    maxCallDepth  int
+    maxIterations int
+    lenient       bool
     modules       map[string]bool
-    returnValue   any
-    errorOccurred bool
-    lastError     error
+    moduleFiles   map[string]*namespace
+    modulePaths   []string
+    importing     []string
+    ns            *namespace
+    nsCopies      map[*namespace]*namespace
+    returnValue   Value
     stdlib        map[string]map[string]BuiltinFunc
+    ctx           context.Context
+    stdout        io.Writer
+    stderr        io.Writer
+    stdin         LineReader
+    file          string
+    line          int
+    treeWalker    bool
+    stack         []Value
 }
 
-// TaskDef stores a task body and parameter list.
+// TaskDef stores a task body and parameter list, and the body's bytecode
+// when the task was defined by compiled code. A task runs in the namespace
+// it was defined in, so a module's tasks see the module's own tasks and
+// globals wherever they are called from. A task brought in with
+// `use a from m` is imported, and is never exported again.
 type TaskDef struct {
-    Body   []Node
-    Params []string
+    Body     []Node
+    Params   []Param
+    code     *code
+    ns       *namespace
+    exported bool
+    imported bool
 }
 
 // NewInterpreter creates a fresh interpreter instance.
 func NewInterpreter() *Interpreter {
+    ns := newNamespace()
     return &Interpreter{
-        tasks:     make(map[string]TaskDef),
-        variables: make(map[string]any),
-        modules:   make(map[string]bool),
-        stdlib:    StdlibModules,
+        tasks:         ns.tasks,
+        globals:       ns.globals,
+        current:       ns.globals,
+        ns:            ns,
+        maxCallDepth:  DefaultMaxCallDepth,
+        maxIterations: DefaultMaxIterations,
+        modules:       make(map[string]bool),
+        moduleFiles:   make(map[string]*namespace),
+        stdlib:        StdlibModules,
+        ctx:           context.Background(),
+        stdout:        os.Stdout,
+        stderr:        os.Stderr,
+        stdin:         bufio.NewReader(os.Stdin),
     }
 }
 
-// Execute runs a list of AST nodes.
-func (i *Interpreter) Execute(nodes []Node) {
+// SetContext sets the context that stops the program when it is canceled
+// or its deadline passes. Loops, task calls and waiting builtins such as
+// time.sleep check it.
+func (i *Interpreter) SetContext(ctx context.Context) {
+    i.ctx = ctx
+}
+
+// SetOutput redirects what the program writes, by `greet` and builtins,
+// to stdout and stderr.
+func (i *Interpreter) SetOutput(stdout, stderr io.Writer) {
+    i.stdout, i.stderr = stdout, stderr
+}
+
+// SetInput sets where the program reads input from, as by io.read_line.
+func (i *Interpreter) SetInput(stdin io.Reader) {
+    i.stdin = bufio.NewReader(stdin)
+}
+
+// SetFile sets the file the program is reported as running from, which is
+// also where modules it uses are searched for first.
+func (i *Interpreter) SetFile(file string) {
+    i.file = file
+}
+
+// SetGlobal sets a top-level variable of the program, converting value as
+// builtin results are: sized integers become int, string slices become
+// lists, and so on.
+func (i *Interpreter) SetGlobal(name string, value any) {
+    i.globals.vars[name] = normalize(value)
+}
+
+// Global returns the value of a top-level variable of the program, with
+// lists and dicts converted to []any and map[string]any.
+func (i *Interpreter) Global(name string) (any, bool) {
+    v, ok := i.globals.vars[name]
+    return hostValue(v), ok
+}
+
+// SetTreeWalker selects the engine Execute uses: the tree-walking
+// evaluator, which runs the AST directly, or by default the bytecode VM.
+// Both give the same results; the tree walker is kept to test the VM
+// against.
+func (i *Interpreter) SetTreeWalker(on bool) {
+    i.treeWalker = on
+}
+
+// SetModulePaths adds folders to search for modules, after the importing
+// file's own folders and before those in ATHERA_PATH.
+func (i *Interpreter) SetModulePaths(dirs []string) {
+    i.modulePaths = dirs
+}
+
+// SetMaxCallDepth limits how deeply tasks may call each other before a
+// recursion error is raised.
+func (i *Interpreter) SetMaxCallDepth(depth int) {
+    i.maxCallDepth = depth
+}
+
+// SetLenient makes an undefined variable evaluate to its own name instead
+// of raising an error, as older scripts that use bare words as strings
+// expect.
+func (i *Interpreter) SetLenient(lenient bool) {
+    i.lenient = lenient
+}
+
+// flow tells the enclosing block how to continue after a statement.
+type flow int
+
+const (
+    flowNext flow = iota
+    flowReturn
+    flowBreak
+    flowContinue
+)
+
+// Execute runs a list of AST nodes. An error that escapes every protect
+// block stops execution and is returned along with the call stack at the
+// point of failure.
+func (i *Interpreter) Execute(nodes []Node) error {
+    return i.run(nodes, nil)
+}
+
+// Run runs a compiled program like Execute, without compiling it again.
+func (i *Interpreter) Run(p *Program) error {
+    return i.run(p.nodes, p.code)
+}
+
+// run executes nodes on the selected engine, on the VM using cd if it has
+// already been compiled.
+func (i *Interpreter) run(nodes []Node, cd *code) (err error) {
+    savedNS := i.ns
+    defer func() {
+        if r := recover(); r != nil {
+            err = i.asRuntimeError(r)
+            i.callStack = nil
+            i.switchNamespace(savedNS)
+            i.current = i.globals
+            i.stack = i.stack[:0]
+        }
+    }()
+    switch {
+    case i.treeWalker:
+        i.executeBlock(nodes)
+    case cd != nil:
+        i.runCode(cd)
+    default:
+        i.runCode(compileProgram(nodes))
+    }
+    return nil
+}
+
+// executeBlock runs statements in order until one of them unwinds.
+func (i *Interpreter) executeBlock(nodes []Node) flow {
     for _, n := range nodes {
-        i.executeNode(n)
+        if f := i.executeNode(n); f != flowNext {
+            return f
+        }
     }
+    return flowNext
 }
 
-func (i *Interpreter) executeNode(n Node) {
+func (i *Interpreter) executeNode(n Node) flow {
+    if positioned, ok := n.(interface{ line() int }); ok {
+        i.line = positioned.line()
+    }
+
     switch node := n.(type) {
     case *TaskNode:
-        i.tasks[node.Name] = TaskDef{Body: node.Body, Params: node.Params}
+        i.tasks[node.Name] = TaskDef{Body: node.Body, Params: node.Params, ns: i.ns, exported: node.Exported}
     case *GreetNode:
         msg := i.evaluateExpression(node.Message)
-        fmt.Println(toString(msg))
+        fmt.Fprintln(i.stdout, toString(msg))
     case *BackupNode:
-        i.executeBackup(node)
+        src := toString(i.evaluateExpression(node.Source))
+        i.backup(src, toString(i.evaluateExpression(node.Dest)))
     case *CheckNode:
-        if i.evaluateCondition(node.Condition) {
-            i.executeInlineAction(node.Action)
+        if node.Action != nil && i.evaluateCondition(node.Condition) {
+            return i.executeNode(node.Action)
         }
-    case *RepeatNNode:
-        for idx := 0; idx < node.Count; idx++ {
-            for _, stmt := range node.Body {
-                i.executeNode(stmt)
+    case *IfNode:
+        for _, branch := range node.Branches {
+            if i.evaluateCondition(branch.Condition) {
+                return i.executeScoped(branch.Body, nil)
             }
         }
-    case *RepeatEachNode:
-        listVal := i.evaluateExpression(node.ListExpr)
-        arr, ok := listVal.([]any)
-        if !ok {
-            // attempt []string fallback
-            if sArr, okStr := listVal.([]string); okStr {
-                for _, item := range sArr {
-                    i.variables[node.Var] = item
-                    for _, stmt := range node.Body {
-                        i.executeNode(stmt)
-                    }
-                }
-                return
-            }
-            fmt.Printf("[Warning: expected list, got %T]\n", listVal)
-            return
-        }
-        for _, item := range arr {
-            i.variables[node.Var] = item
-            for _, stmt := range node.Body {
-                i.executeNode(stmt)
-            }
+        if node.Else != nil {
+            return i.executeScoped(node.Else, nil)
         }
+    case *RepeatNNode:
+        return i.executeRepeatN(node)
+    case *RepeatEachNode:
+        return i.executeRepeatEach(node)
+    case *RepeatWhileNode:
+        return i.executeRepeatWhile(node)
+    case *BreakNode:
+        return flowBreak
+    case *ContinueNode:
+        return flowContinue
     case *SetNode:
-        i.variables[node.Var] = i.evaluateExpression(node.Value)
+        if node.Target != nil {
+            i.assignElement(node.Target, i.evaluateExpression(node.Value))
+        } else {
+            i.assignVar(node.Var, i.evaluateExpression(node.Value))
+        }
     case *RunNode:
-        i.executeRun(node)
+        args, named := i.evaluateArgs(node.Args, node.Named)
+        if fn, ok := i.lookupVar(node.Task); ok {
+            i.callValue(fn, args, named, node.Line)
+        } else {
+            i.callTask(node.Task, args, named, node.Line)
+        }
     case *UseNode:
         i.executeUse(node)
     case *ProtectNode:
-        i.executeProtect(node)
-    case *HandleInlineNode:
-        if i.errorOccurred {
-            i.executeInlineAction(node.Action)
-        }
+        return i.executeProtect(node)
+    case *RaiseNode:
+        i.executeRaise(node)
     case *RunParallelNode:
-        i.executeRunParallel(node)
+        i.runParallel(node, i.current.flatten())
     case *ReturnNode:
-        i.returnValue = i.evaluateExpression(node.Expr)
+        i.returnValue = i.evaluateExpression(node.Value)
+        return flowReturn
+    case *ExprNode:
+        i.evaluateExpression(node.Expr)
+    case *GlobalNode:
+        frame := i.current.frameScope()
+        for _, name := range node.Names {
+            frame.globals[name] = true
+        }
     }
+    return flowNext
 }
 
-func (i *Interpreter) executeBackup(node *BackupNode) {
-    src := toString(i.evaluateExpression(node.Source))
-    dst := toString(i.evaluateExpression(node.Dest))
-
-    src = strings.Trim(src, "\"'")
-    dst = strings.Trim(dst, "\"'")
-
+// backup copies the file src into the folder dst.
+func (i *Interpreter) backup(src, dst string) {
     if src == "" || dst == "" {
-        fmt.Println("[Backup error: source or destination missing]")
-        return
-    }
-
-    if err := os.MkdirAll(dst, 0o755); err != nil {
-        fmt.Printf("[Backup error: %v]\n", err)
-        return
+        i.raise(KindArgument, "backup: source or destination missing")
     }
 
     info, err := os.Stat(src)
     if err != nil {
-        fmt.Printf("[Backup error: %v]\n", err)
-        return
+        i.raise(errorKind(err), "backup: %v", err)
+    }
+
+    if err := os.MkdirAll(dst, 0o755); err != nil {
+        i.raise(errorKind(err), "backup: %v", err)
     }
 
     destPath := filepath.Join(dst, filepath.Base(src))
 
     if info.IsDir() {
-        fmt.Printf("[Backup warning: directory backup not yet supported: %s]\n", src)
+        fmt.Fprintf(i.stdout, "[Backup warning: directory backup not yet supported: %s]\n", src)
         return
     }
 
     in, err := os.Open(src)
     if err != nil {
-        fmt.Printf("[Backup error: %v]\n", err)
-        return
+        i.raise(errorKind(err), "backup: %v", err)
     }
     defer in.Close()
 
     out, err := os.Create(destPath)
     if err != nil {
-        fmt.Printf("[Backup error: %v]\n", err)
-        return
+        i.raise(errorKind(err), "backup: %v", err)
     }
     defer out.Close()
 
     if _, err := io.Copy(out, in); err != nil {
-        fmt.Printf("[Backup error: %v]\n", err)
-        return
+        i.raise(errorKind(err), "backup: %v", err)
     }
 
-    fmt.Printf("[Backed up: %s -> %s]\n", src, destPath)
-}
-
-func (i *Interpreter) executeConditionAction(action string) {
-    i.executeInlineAction(action)
+    fmt.Fprintf(i.stdout, "[Backed up: %s -> %s]\n", src, destPath)
 }
 
-func (i *Interpreter) evaluateCondition(expr string) bool {
-    expr = strings.TrimSpace(expr)
-
+func (i *Interpreter) evaluateCondition(expr Expr) bool {
     // quoted path check
-    if strings.HasPrefix(expr, "\"") || strings.HasPrefix(expr, "'") {
-        path := strings.Trim(expr, "\"'")
-        path = toString(i.evaluateExpression(path))
-        _, err := os.Stat(path)
+    if lit, ok := expr.(*LiteralExpr); ok {
+        if path, isStr := lit.Value.(string); isStr {
+            _, err := os.Stat(path)
+            return err == nil
+        }
+    }
+    if tmpl, ok := expr.(*InterpolatedExpr); ok {
+        _, err := os.Stat(toString(i.evaluateExpression(tmpl)))
         return err == nil
     }
+    return isTruthy(i.evaluateExpression(expr))
+}
 
-    if val, ok := i.variables[expr]; ok {
-        switch v := val.(type) {
-        case bool:
-            return v
-        case int:
-            return v != 0
-        case float64:
-            return v != 0
-        case string:
-            return v != ""
-        case []any:
-            return len(v) > 0
-        case []string:
-            return len(v) > 0
-        }
-    }
+// callTask runs a task with evaluated arguments in a new frame and returns
+// the value it returned, or nil. line is the call site, kept on the call
+// stack for error reports.
+func (i *Interpreter) callTask(name string, args []Value, named map[string]Value, line int) Value {
+    return i.callTaskIn(i.ns, name, args, named, line)
+}
 
-    // fall back to arithmetic-like evaluation
-    if res := i.evaluateExpression(expr); res != nil {
-        switch v := res.(type) {
-        case bool:
-            return v
-        case int:
-            return v != 0
-        case float64:
-            return v != 0
-        case string:
-            return v != ""
+// callTaskIn calls the task name of namespace ns. A qualified name such as
+// `math_utils.square` calls a task of an imported module.
+func (i *Interpreter) callTaskIn(ns *namespace, name string, args []Value, named map[string]Value, line int) Value {
+    def, ok := ns.tasks[name]
+    if !ok {
+        if ref, found := ns.qualifiedTask(name); found {
+            return i.callValue(ref, args, named, line)
         }
+        i.raise(KindTaskNotFound, "task '%s' not found", name)
     }
-
-    return false
+    if def.code != nil {
+        return i.invokeCode(name, &def, nil, args, named, line)
+    }
+    return i.invoke(name, def, nil, args, named, line)
 }
 
-func (i *Interpreter) executeInlineAction(action string) {
-    action = strings.TrimSpace(action)
-    if strings.HasPrefix(action, "greet ") {
-        msg := strings.TrimSpace(action[len("greet "):])
-        msgVal := i.evaluateExpression(msg)
-        fmt.Println(toString(msgVal))
+// callValue calls a task value, such as a task passed as an argument or an
+// anonymous task.
+func (i *Interpreter) callValue(fn Value, args []Value, named map[string]Value, line int) Value {
+    ref, ok := fn.(*TaskRef)
+    if !ok {
+        i.raise(KindType, "%s is not callable", typeName(fn))
+    }
+    if ref.lambda != nil && ref.lambda.code != nil {
+        return i.invokeCode(ref.Name, ref.lambda, ref.upvals, args, named, line)
+    }
+    if ref.lambda != nil {
+        return i.invoke(ref.Name, *ref.lambda, ref.closure, args, named, line)
     }
+    if ref.ns != nil {
+        return i.callTaskIn(ref.ns, ref.Name, args, named, line)
+    }
+    return i.callTask(ref.Name, args, named, line)
 }
 
-func (i *Interpreter) executeRun(node *RunNode) {
-    target := strings.TrimSpace(node.Target)
-    name := target
-    var args []string
-
-    if strings.Contains(target, " ") {
-        parts := strings.SplitN(target, " ", 2)
-        name = parts[0]
-        args = splitArgsRespectingQuotes(parts[1])
-    }
+// invoke runs a task body in a new frame whose enclosing scope is parent:
+// the defining scope for anonymous tasks, or if nil, the globals of the
+// task's namespace.
+func (i *Interpreter) invoke(name string, def TaskDef, parent *scope, args []Value, named map[string]Value, line int) Value {
+    i.checkContext()
+    if len(i.callStack) >= i.maxCallDepth {
+        i.raise(KindRecursion, "maximum call depth of %d exceeded calling task '%s'", i.maxCallDepth, name)
+    }
+
+    savedNS := i.switchNamespace(def.ns)
+    if parent == nil {
+        parent = i.globals
+    }
+    saved, savedLine := i.current, i.line
+    i.current, i.line = newScope(parent, true), line
+    vars := i.current.vars
+    i.bindArgs(name, def.Params, args, named, func(idx int, v Value) {
+        vars[def.Params[idx].Name] = v
+    }, func(idx int) Value {
+        return i.evaluateExpression(def.Params[idx].Default)
+    })
+    i.callStack = append(i.callStack, StackFrame{Task: name, Line: line})
 
-    def, ok := i.tasks[name]
-    if !ok {
-        fmt.Printf("[Error: task '%s' not found]\n", name)
-        return
-    }
+    i.returnValue = nil
+    i.executeBlock(def.Body)
+    result := i.returnValue
+    i.returnValue = nil
 
-    saved := copyMap(i.variables)
+    i.callStack = i.callStack[:len(i.callStack)-1]
+    i.current, i.line = saved, savedLine
+    i.switchNamespace(savedNS)
+    return result
+}
 
-    for idx, param := range def.Params {
-        if idx < len(args) {
-            i.variables[param] = i.evaluateExpression(args[idx])
-        } else {
-            i.variables[param] = nil
+// bindArgs binds the arguments of a call to the task's parameters, handing
+// each value to bind along with the parameter's index. Arguments are
+// matched by position, then by name, then defaults are evaluated in order
+// by eval so they can refer to earlier parameters. Missing, extra and
+// unknown arguments raise an ArgumentError.
+func (i *Interpreter) bindArgs(name string, params []Param, args []Value, named map[string]Value, bind func(int, Value), eval func(int) Value) {
+    for _, key := range sortedKeys(named) {
+        if !hasParam(params, key) {
+            i.raise(KindArgument, "task '%s' has no parameter '%s'", name, key)
         }
     }
 
-    i.returnValue = nil
-    for _, stmt := range def.Body {
-        i.executeNode(stmt)
-        if i.returnValue != nil {
-            break
+    next := 0
+    for idx, param := range params {
+        value, isNamed := named[param.Name]
+        switch {
+        case param.Rest:
+            rest := []Value{}
+            if next < len(args) {
+                rest = append(rest, args[next:]...)
+            }
+            bind(idx, rest)
+            next = len(args)
+        case next < len(args):
+            if isNamed {
+                i.raise(KindArgument, "task '%s' got argument '%s' both by position and by name", name, param.Name)
+            }
+            bind(idx, args[next])
+            next++
+        case isNamed:
+            bind(idx, value)
+        case param.Default != nil:
+            bind(idx, eval(idx))
+        default:
+            i.raise(KindArgument, "task '%s' is missing argument '%s'", name, param.Name)
         }
     }
-
-    for _, param := range def.Params {
-        if val, exists := saved[param]; exists {
-            i.variables[param] = val
-        } else {
-            delete(i.variables, param)
-        }
+    if next < len(args) {
+        i.raise(KindArgument, "task '%s' takes %d positional arguments but %d were given", name, next, len(args))
     }
 }
 
-func (i *Interpreter) executeUse(node *UseNode) {
-    name := strings.TrimSpace(node.Module)
-    if _, ok := StdlibModules[name]; ok {
-        i.modules[name] = true
-        fmt.Printf("[Imported built-in module: %s]\n", name)
-        return
+// hasParam reports whether name can be passed by name to a task with the
+// given parameters.
+func hasParam(params []Param, name string) bool {
+    for _, param := range params {
+        if param.Name == name && !param.Rest {
+            return true
+        }
     }
-
-    // Future: load external .ath modules if present.
-    fmt.Printf("[Warning: module %s not found]\n", name)
+    return false
 }
 
-func (i *Interpreter) executeProtect(node *ProtectNode) {
-    i.errorOccurred = false
-    i.lastError = nil
+// executeProtect runs the protect block. A runtime error raised anywhere
+// inside it, including in called tasks, is caught here and the first handle
+// clause matching its kind runs with the error bound to `error`. Errors no
+// clause matches keep unwinding.
+func (i *Interpreter) executeProtect(node *ProtectNode) (result flow) {
+    savedScope, savedDepth, savedNS := i.current, len(i.callStack), i.ns
 
     defer func() {
-        if r := recover(); r != nil {
-            i.errorOccurred = true
-            i.lastError = fmt.Errorf("%v", r)
-            fmt.Printf("[Error caught: %v]\n", r)
-            for _, stmt := range node.Handle {
-                i.executeNode(stmt)
+        r := recover()
+        if r == nil {
+            return
+        }
+        rtErr := i.asRuntimeError(r)
+        i.switchNamespace(savedNS)
+        i.current, i.callStack = savedScope, i.callStack[:savedDepth]
+        bind := map[string]Value{"error": rtErr}
+        for _, h := range node.Handlers {
+            switch clause := h.(type) {
+            case *HandleBlockNode:
+                if kindMatches(rtErr.Kind, clause.ErrorType) {
+                    result = i.executeScoped(clause.Body, bind)
+                    return
+                }
+            case *HandleInlineNode:
+                if kindMatches(rtErr.Kind, clause.ErrorType) {
+                    if clause.Action != nil {
+                        result = i.executeScoped([]Node{clause.Action}, bind)
+                    }
+                    return
+                }
             }
         }
+        panic(rtErr)
     }()
 
-    for _, stmt := range node.Protect {
-        i.executeNode(stmt)
-        if i.errorOccurred {
-            break
-        }
+    return i.executeBlock(node.Protect)
+}
+
+// executeRaise raises a user error. The kind defaults to UserError and the
+// message to the kind.
+func (i *Interpreter) executeRaise(node *RaiseNode) {
+    kind := node.Kind
+    if kind == "" {
+        kind = KindUser
     }
+    msg := kind
+    if node.Message != nil {
+        msg = toString(i.evaluateExpression(node.Message))
+    }
+    i.raise(kind, "%s", msg)
 }
 
-func (i *Interpreter) executeRunParallel(node *RunParallelNode) {
-    var wg sync.WaitGroup
+// runParallel runs tasks concurrently, each in an isolated interpreter
+// starting from its own deep copy of vars. If any of them fails, the first
+// error is raised once all have finished.
+func (i *Interpreter) runParallel(node *RunParallelNode, vars map[string]Value) {
+    defs := make([]TaskDef, 0, len(node.Tasks))
     for _, taskName := range node.Tasks {
-        tn := strings.TrimSpace(taskName)
-        def, ok := i.tasks[tn]
+        def, ok := i.tasks[taskName]
         if !ok {
-            fmt.Printf("[Warning: task %s not found for parallel run]\n", tn)
-            continue
+            i.raise(KindTaskNotFound, "task '%s' not found for parallel run", taskName)
         }
+        defs = append(defs, def)
+    }
 
+    // Copy before any task starts, so that no copy is taken while another
+    // task is changing its own.
+    seeds := make([]map[string]Value, len(defs))
+    for idx := range defs {
+        seeds[idx] = isolateVars(vars)
+    }
+
+    // The tasks share the program's streams, so each write and read takes
+    // a lock. Input has its own, so a task waiting for a line does not hold
+    // up the others' output.
+    var outMu, inMu sync.Mutex
+    stdout := lockedWriter{mu: &outMu, w: i.stdout}
+    stderr := lockedWriter{mu: &outMu, w: i.stderr}
+    stdin := lockedReader{mu: &inMu, r: i.stdin}
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var firstErr *RuntimeError
+    for idx, def := range defs {
         wg.Add(1)
-        go func(td TaskDef) {
+        go func(name string, td TaskDef, seed map[string]Value) {
             defer wg.Done()
             // copy variables for isolation
             local := NewInterpreter()
-            local.tasks = i.tasks
-            local.variables = copyMap(i.variables)
-            for _, stmt := range td.Body {
-                local.executeNode(stmt)
-            }
-        }(def)
+            local.copyNamespace(i.ns)
+            local.lenient = i.lenient
+            local.treeWalker = i.treeWalker
+            local.ctx = i.ctx
+            local.stdout, local.stderr, local.stdin = stdout, stderr, stdin
+            local.file = i.file
+            local.globals.vars = seed
+            local.callStack = []StackFrame{{Task: name, Line: i.line}}
+            defer func() {
+                if r := recover(); r != nil {
+                    mu.Lock()
+                    if firstErr == nil {
+                        firstErr = local.asRuntimeError(r)
+                    }
+                    mu.Unlock()
+                }
+            }()
+            local.runBody(td)
+        }(node.Tasks[idx], def, seeds[idx])
     }
 
     wg.Wait()
-    fmt.Printf("[Parallel execution complete: %d tasks]\n", len(node.Tasks))
+    if firstErr != nil {
+        panic(firstErr)
+    }
+    fmt.Fprintf(i.stdout, "[Parallel execution complete: %d tasks]\n", len(node.Tasks))
 }
 
-// evaluateExpression resolves literals, variables, and stdlib calls.
-func (i *Interpreter) evaluateExpression(expr string) any {
-    expr = strings.TrimSpace(expr)
-    if expr == "" {
-        return ""
-    }
+// lockedWriter serializes writes to a stream shared by parallel tasks.
+type lockedWriter struct {
+    mu *sync.Mutex
+    w  io.Writer
+}
 
-    if (strings.HasPrefix(expr, "\"") && strings.HasSuffix(expr, "\"")) || (strings.HasPrefix(expr, "'") && strings.HasSuffix(expr, "'")) {
-        return strings.Trim(expr, "\"'")
-    }
+func (l lockedWriter) Write(p []byte) (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.w.Write(p)
+}
 
-    if strings.HasPrefix(expr, "[") && strings.HasSuffix(expr, "]") {
-        return i.parseList(expr)
-    }
+// lockedReader serializes reads from input shared by parallel tasks.
+type lockedReader struct {
+    mu *sync.Mutex
+    r  LineReader
+}
 
-    if strings.EqualFold(expr, "true") {
-        return true
-    }
-    if strings.EqualFold(expr, "false") {
-        return false
-    }
+func (l lockedReader) ReadString(delim byte) (string, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.r.ReadString(delim)
+}
 
-    if v, err := strconv.Atoi(expr); err == nil {
-        return v
-    }
-    if f, err := strconv.ParseFloat(expr, 64); err == nil {
-        return f
+// evaluateExpression resolves literals, variables, operators and stdlib calls.
+func (i *Interpreter) evaluateExpression(expr Expr) Value {
+    switch e := expr.(type) {
+    case nil:
+        return nil
+    case *LiteralExpr:
+        return e.Value
+    case *InterpolatedExpr:
+        var sb strings.Builder
+        for _, part := range e.Parts {
+            sb.WriteString(toString(i.evaluateExpression(part)))
+        }
+        return sb.String()
+    case *IdentExpr:
+        if val, ok := i.lookupVar(e.Name); ok {
+            return val
+        }
+        if _, ok := i.tasks[e.Name]; ok {
+            return &TaskRef{Name: e.Name, ns: i.ns}
+        }
+        if i.lenient {
+            return e.Name
+        }
+        i.raiseUndefined(e.Name, i.current.flatten())
+    case *ListExpr:
+        items := make([]Value, 0, len(e.Items))
+        for _, item := range e.Items {
+            items = append(items, i.evaluateExpression(item))
+        }
+        return items
+    case *DictExpr:
+        dict := make(map[string]Value, len(e.Keys))
+        for idx, key := range e.Keys {
+            dict[key] = i.evaluateExpression(e.Values[idx])
+        }
+        return dict
+    case *UnaryExpr:
+        operand := i.evaluateExpression(e.Operand)
+        if e.Op == "not" {
+            return !isTruthy(operand)
+        }
+        res, err := negate(operand)
+        if err != nil {
+            i.raise(errorKind(err), "%v", err)
+        }
+        return res
+    case *BinaryExpr:
+        left := i.evaluateExpression(e.Left)
+        switch e.Op {
+        case "and":
+            return isTruthy(left) && isTruthy(i.evaluateExpression(e.Right))
+        case "or":
+            return isTruthy(left) || isTruthy(i.evaluateExpression(e.Right))
+        }
+        res, err := binaryOp(e.Op, left, i.evaluateExpression(e.Right))
+        if err != nil {
+            i.raise(errorKind(err), "%v", err)
+        }
+        return res
+    case *MemberExpr:
+        if fn, ok := i.lookupBuiltin(e); ok {
+            return i.callBuiltin(e.Object.(*IdentExpr).Name+"."+e.Name, fn, nil, nil)
+        }
+        res, err := memberOf(i.evaluateExpression(e.Object), e.Name)
+        if err != nil {
+            i.raise(errorKind(err), "%v", err)
+        }
+        return res
+    case *IndexExpr:
+        res, err := indexOf(i.evaluateExpression(e.Object), i.evaluateExpression(e.Index))
+        if err != nil {
+            i.raise(errorKind(err), "%v", err)
+        }
+        return res
+    case *SliceExpr:
+        var start, end Value
+        if e.Start != nil {
+            start = i.evaluateExpression(e.Start)
+        }
+        if e.End != nil {
+            end = i.evaluateExpression(e.End)
+        }
+        res, err := sliceOf(i.evaluateExpression(e.Object), start, end)
+        if err != nil {
+            i.raise(errorKind(err), "%v", err)
+        }
+        return res
+    case *CallExpr:
+        return i.evaluateCall(e)
+    case *LambdaExpr:
+        body := &ReturnNode{Pos: e.Pos, Value: e.Body}
+        def := &TaskDef{Params: e.Params, Body: []Node{body}, ns: i.ns}
+        return &TaskRef{Name: "lambda", lambda: def, closure: i.current}
     }
+    return nil
+}
 
-    if val, ok := i.variables[expr]; ok {
-        return val
-    }
+func (i *Interpreter) evaluateCall(call *CallExpr) Value {
+    args, named := i.evaluateArgs(call.Args, call.Named)
 
-    // property access like myList.length
-    if strings.Contains(expr, ".") && !strings.Contains(expr, " ") {
-        parts := strings.Split(expr, ".")
-        if len(parts) == 2 {
-            base := parts[0]
-            prop := parts[1]
-            if val, ok := i.variables[base]; ok {
-                switch prop {
-                case "length":
-                    switch v := val.(type) {
-                    case string:
-                        return len([]rune(v))
-                    case []any:
-                        return len(v)
-                    case []string:
-                        return len(v)
-                    }
-                case "is_empty":
-                    switch v := val.(type) {
-                    case string:
-                        return v == ""
-                    case []any:
-                        return len(v) == 0
-                    case []string:
-                        return len(v) == 0
-                    }
-                }
-            }
+    switch callee := call.Callee.(type) {
+    case *IdentExpr:
+        if fn, ok := i.lookupVar(callee.Name); ok {
+            return i.callValue(fn, args, named, call.Line)
         }
-    }
-
-    if strings.Contains(expr, ".") {
-        modCall := strings.SplitN(expr, ".", 2)
-        modName := strings.TrimSpace(modCall[0])
-        if len(modCall) == 2 {
-            rest := strings.TrimSpace(modCall[1])
-            fnParts := strings.SplitN(rest, " ", 2)
-            fnName := strings.TrimSpace(fnParts[0])
-            argStr := ""
-            if len(fnParts) > 1 {
-                argStr = fnParts[1]
+        if _, isTask := i.tasks[callee.Name]; !isTask {
+            if fn, ok := GlobalBuiltins[callee.Name]; ok {
+                return i.callBuiltin(callee.Name, fn, args, named)
             }
-
-            if modFuncs, ok := i.stdlib[modName]; ok {
-                if fn, okFn := modFuncs[fnName]; okFn {
-                    rawArgs := splitArgsRespectingQuotes(argStr)
-                    args := make([]any, 0, len(rawArgs))
-                    for _, a := range rawArgs {
-                        args = append(args, i.evaluateExpression(a))
-                    }
-                    res, err := fn(args)
-                    if err != nil {
-                        fmt.Printf("[Error: %v]\n", err)
-                        return nil
-                    }
-                    return res
-                }
+        }
+        return i.callTask(callee.Name, args, named, call.Line)
+    case *MemberExpr:
+        if fn, ok := i.lookupBuiltin(callee); ok {
+            return i.callBuiltin(callee.Object.(*IdentExpr).Name+"."+callee.Name, fn, args, named)
+        }
+        // A variable named like a stdlib module hides it, and the call is
+        // on the variable's member.
+        if isModuleMember(callee) {
+            if _, shadowed := i.lookupVar(callee.Object.(*IdentExpr).Name); !shadowed {
+                i.raise(KindRuntime, "unknown function %s", callee.Name)
             }
         }
+        if ident, ok := callee.Object.(*IdentExpr); ok {
+            return i.callMember(i.evaluateExpression(ident), ident.Name, callee.Name, args, named, call.Line)
+        }
     }
+    return i.callValue(i.evaluateExpression(call.Callee), args, named, call.Line)
+}
 
-    // simple addition support: a + b
-    if strings.Contains(expr, "+") {
-        parts := strings.Split(expr, "+")
-        if len(parts) == 2 {
-            left := i.evaluateExpression(parts[0])
-            right := i.evaluateExpression(parts[1])
-            switch l := left.(type) {
-            case int:
-                if r, ok := right.(int); ok {
-                    return l + r
-                }
-                if r, ok := right.(float64); ok {
-                    return float64(l) + r
-                }
-            case float64:
-                if r, ok := right.(int); ok {
-                    return l + float64(r)
-                }
-                if r, ok := right.(float64); ok {
-                    return l + r
-                }
-            case string:
-                return l + toString(right)
-            }
+// callMember calls the member name of object, the value of the variable
+// objName, as in `lib.square(3)`. A dict without the member, such as a
+// module that does not export it, raises TaskNotFound as `run lib.helper`
+// does.
+func (i *Interpreter) callMember(object Value, objName, name string, args []Value, named map[string]Value, line int) Value {
+    if dict, ok := object.(map[string]Value); ok {
+        if _, found := dict[name]; !found {
+            i.raise(KindTaskNotFound, "task '%s.%s' not found", objName, name)
         }
     }
-
-    return expr
+    callee, err := memberOf(object, name)
+    i.check(err)
+    return i.callValue(callee, args, named, line)
 }
 
-func (i *Interpreter) parseList(expr string) []any {
-    inner := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(expr, "["), "]"))
-    if inner == "" {
-        return []any{}
+// evaluateArgs evaluates a call's arguments in source order: positional
+// ones into a list and named ones into a map, nil if there are none.
+func (i *Interpreter) evaluateArgs(exprs []Expr, namedExprs []NamedArg) ([]Value, map[string]Value) {
+    args := make([]Value, 0, len(exprs))
+    for _, arg := range exprs {
+        args = append(args, i.evaluateExpression(arg))
     }
+    if len(namedExprs) == 0 {
+        return args, nil
+    }
+    named := make(map[string]Value, len(namedExprs))
+    for _, arg := range namedExprs {
+        named[arg.Name] = i.evaluateExpression(arg.Value)
+    }
+    return args, named
+}
 
-    var items []any
-    current := ""
-    inQuotes := false
-    quoteChar := byte(0)
-    bracketDepth := 0
-
-    for idx := 0; idx < len(inner); idx++ {
-        ch := inner[idx]
-        switch ch {
-        case '\'', '"':
-            if !inQuotes {
-                inQuotes = true
-                quoteChar = ch
-                current += string(ch)
-            } else if quoteChar == ch {
-                inQuotes = false
-                current += string(ch)
-            } else {
-                current += string(ch)
-            }
-        case '[':
-            if !inQuotes {
-                bracketDepth++
-            }
-            current += string(ch)
-        case ']':
-            if !inQuotes {
-                if bracketDepth > 0 {
-                    bracketDepth--
-                }
-            }
-            current += string(ch)
-        case ',':
-            if inQuotes || bracketDepth > 0 {
-                current += string(ch)
-                continue
-            }
-            items = append(items, i.evaluateExpression(current))
-            current = ""
-        default:
-            current += string(ch)
-        }
+// lookupBuiltin resolves `module.fn` to a stdlib function unless the module
+// name is shadowed by a variable.
+func (i *Interpreter) lookupBuiltin(member *MemberExpr) (BuiltinFunc, bool) {
+    ident, ok := member.Object.(*IdentExpr)
+    if !ok {
+        return nil, false
+    }
+    if _, shadowed := i.lookupVar(ident.Name); shadowed {
+        return nil, false
+    }
+    modFuncs, ok := i.stdlib[ident.Name]
+    if !ok {
+        return nil, false
     }
-    if strings.TrimSpace(current) != "" {
-        items = append(items, i.evaluateExpression(current))
+    fn, ok := modFuncs[member.Name]
+    return fn, ok
+}
+
+// Call calls a task value with the given arguments and returns its result.
+// A runtime error raised inside the task is returned as a *RuntimeError.
+func (i *Interpreter) Call(fn Value, args ...Value) (result Value, err error) {
+    if _, ok := fn.(*TaskRef); !ok {
+        return nil, typeError("expected a task, got %s", typeName(fn))
     }
-    return items
+    saved, savedDepth, savedLine, savedSP := i.current, len(i.callStack), i.line, len(i.stack)
+    savedNS := i.ns
+    defer func() {
+        if r := recover(); r != nil {
+            err = i.asRuntimeError(r)
+            i.switchNamespace(savedNS)
+            i.current, i.callStack, i.line = saved, i.callStack[:savedDepth], savedLine
+            i.stack = i.stack[:savedSP]
+        }
+    }()
+    return i.callValue(fn, args, nil, i.line), nil
 }
 
-// Helpers
-func splitArgsRespectingQuotes(input string) []string {
-    var args []string
-    current := strings.Builder{}
-    inQuotes := false
-    quoteChar := byte(0)
-    bracketDepth := 0
+// CallTask calls the task name, which may be qualified by a module as in
+// `math_utils.square`, and returns its result. A runtime error raised
+// inside the task is returned as a *RuntimeError. The call is made from
+// no line of the program, so errors it raises directly carry line zero.
+// Arguments are converted as by SetGlobal, and the result as by Global.
+func (i *Interpreter) CallTask(name string, args ...any) (any, error) {
+    values := make([]Value, len(args))
+    for idx, arg := range args {
+        values[idx] = normalize(arg)
+    }
+    savedLine := i.line
+    i.line = 0
+    defer func() { i.line = savedLine }()
+    result, err := i.Call(&TaskRef{Name: name, ns: i.ns}, values...)
+    return hostValue(result), err
+}
 
-    flush := func() {
-        val := strings.TrimSpace(current.String())
-        if val != "" {
-            args = append(args, val)
+// callBuiltin calls the builtin named name. Errors are raised as runtime
+// errors prefixed with the name, and the result is normalized. A
+// *RuntimeError, such as one from a task the builtin called, is raised
+// unchanged. Named arguments are passed on to the builtin; one its
+// signature does not declare raises an ArgumentError.
+func (i *Interpreter) callBuiltin(name string, fn BuiltinFunc, args []Value, named map[string]Value) Value {
+    for _, key := range sortedKeys(named) {
+        if _, ok := signatures[name].named[key]; !ok {
+            i.raise(KindArgument, "%s has no parameter '%s'", name, key)
         }
-        current.Reset()
     }
-
-    for idx := 0; idx < len(input); idx++ {
-        ch := input[idx]
-        switch ch {
-        case '\'', '"':
-            if !inQuotes {
-                inQuotes = true
-                quoteChar = ch
-            } else if quoteChar == ch {
-                inQuotes = false
-            }
-            current.WriteByte(ch)
-        case '[':
-            if !inQuotes {
-                bracketDepth++
-            }
-            current.WriteByte(ch)
-        case ']':
-            if !inQuotes && bracketDepth > 0 {
-                bracketDepth--
-            }
-            current.WriteByte(ch)
-        case ',':
-            if inQuotes || bracketDepth > 0 {
-                current.WriteByte(ch)
-                continue
-            }
-            flush()
-        default:
-            current.WriteByte(ch)
+    c := &CallContext{
+        Interp: i,
+        Ctx:    i.ctx,
+        Stdout: i.stdout,
+        Stderr: i.stderr,
+        Stdin:  i.stdin,
+        Name:   name,
+        File:   i.file,
+        Line:   i.line,
+        Named:  named,
+    }
+    res, err := fn(c, args)
+    if err != nil {
+        var rtErr *RuntimeError
+        if errors.As(err, &rtErr) {
+            panic(rtErr)
+        }
+        msg := err.Error()
+        if !strings.HasPrefix(msg, name) {
+            msg = name + ": " + msg
         }
+        i.raise(errorKind(err), "%s", msg)
     }
-    flush()
-    return args
+    return normalize(res)
 }
 
-func copyMap(in map[string]any) map[string]any {
-    out := make(map[string]any, len(in))
-    for k, v := range in {
-        out[k] = v
-    }
-    return out
+// Options configures how RunFile and RunSource execute a program.
+type Options struct {
+    // MaxCallDepth limits task recursion; zero means DefaultMaxCallDepth.
+    MaxCallDepth int
+    // MaxIterations limits the passes of a single loop; zero means
+    // DefaultMaxIterations.
+    MaxIterations int
+    // Lenient treats undefined variables as their own names; see
+    // Interpreter.SetLenient.
+    Lenient bool
+    // Timeout stops the program with a Timeout error once it has run this
+    // long; zero means no limit.
+    Timeout time.Duration
+    // TreeWalker runs the program on the tree-walking evaluator instead of
+    // the bytecode VM; see Interpreter.SetTreeWalker.
+    TreeWalker bool
+    // Stdout and Stderr receive the program's output; nil means os.Stdout
+    // and os.Stderr.
+    Stdout io.Writer
+    Stderr io.Writer
+    // Stdin is what the program reads input from; nil means os.Stdin.
+    Stdin io.Reader
+    // ModulePaths lists extra folders to search for modules; see
+    // Interpreter.SetModulePaths.
+    ModulePaths []string
 }
 
 // RunFile loads and runs an Athera program from disk.
-func RunFile(path string) error {
+func RunFile(path string, opts Options) error {
     data, err := os.ReadFile(path)
     if err != nil {
         return err
     }
-    return RunSource(string(data))
+    return runNamedSource(path, string(data), opts)
 }
 
 // RunSource runs Athera code from a string using a fresh interpreter.
-func RunSource(src string) error {
-    lexer := NewLexer(src)
-    tokens := lexer.Tokenize()
-    parser := NewParser(tokens)
-    ast := parser.Parse()
+func RunSource(src string, opts Options) error {
+    return runNamedSource("<source>", src, opts)
+}
+
+// runNamedSource compiles src and, if it is free of syntax errors, runs it.
+func runNamedSource(file, src string, opts Options) error {
+    prog, diags := Compile(file, src)
+    if len(diags) > 0 {
+        return &ParseError{Diagnostics: diags}
+    }
 
     interpreter := NewInterpreter()
-    interpreter.Execute(ast)
-    return nil
+    interpreter.file = file
+    interpreter.enterProgram(file)
+    if opts.MaxCallDepth > 0 {
+        interpreter.SetMaxCallDepth(opts.MaxCallDepth)
+    }
+    if opts.MaxIterations > 0 {
+        interpreter.SetMaxIterations(opts.MaxIterations)
+    }
+    interpreter.SetLenient(opts.Lenient)
+    interpreter.SetTreeWalker(opts.TreeWalker)
+    interpreter.SetModulePaths(opts.ModulePaths)
+    if opts.Stdout != nil {
+        interpreter.stdout = opts.Stdout
+    }
+    if opts.Stderr != nil {
+        interpreter.stderr = opts.Stderr
+    }
+    if opts.Stdin != nil {
+        interpreter.SetInput(opts.Stdin)
+    }
+    if opts.Timeout > 0 {
+        ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+        defer cancel()
+        interpreter.SetContext(ctx)
+    }
+    return interpreter.Run(prog)
 }
@@ -1,145 +1,378 @@
 package lang
 
 import (
-    "regexp"
     "strconv"
     "strings"
+    "unicode"
 )
 
 // Token represents a lexical token.
 type Token struct {
-    Type  string
-    Value string
-    Line  int
+    Type   string
+    Value  string
+    Line   int
+    Column int
 }
 
+// keywords are the reserved words of the language.
+var keywords = map[string]bool{
+    "task":     true,
+    "with":     true,
+    "greet":    true,
+    "backup":   true,
+    "to":       true,
+    "check":    true,
+    "repeat":   true,
+    "times":    true,
+    "each":     true,
+    "in":       true,
+    "set":      true,
+    "run":      true,
+    "parallel": true,
+    "use":      true,
+    "export":   true,
+    "protect":  true,
+    "handle":   true,
+    "return":   true,
+    "true":     true,
+    "false":    true,
+    "null":     true,
+    "none":     true,
+    "and":      true,
+    "or":       true,
+    "not":      true,
+    "global":   true,
+    "raise":    true,
+    "if":       true,
+    "else":     true,
+    "while":    true,
+    "until":    true,
+    "break":    true,
+    "continue": true,
+}
+
+// operators lists multi- and single-character operators, longest first.
+var operators = []string{"...", "->", "==", "!=", "<=", ">=", "=", "<", ">", "+", "-", "*", "/", "%"}
+
 // Lexer converts source code into tokens.
 type Lexer struct {
-    source string
-    lines  []string
+    source []rune
+    pos    int
+    line   int
+    column int
+    depth  int
     tokens []Token
 }
 
 // NewLexer creates a lexer for the provided source.
 func NewLexer(src string) *Lexer {
-    return &Lexer{source: src, lines: strings.Split(src, "\n"), tokens: []Token{}}
+    return &Lexer{source: []rune(src), line: 1, column: 1, tokens: []Token{}}
 }
 
 // Tokenize lexes the source into a slice of tokens.
+//
+// Every logical line yields an optional INDENT token carrying its indentation
+// width, the tokens of the line itself and a closing NEWLINE. Blank lines and
+// comment-only lines produce no tokens, and line breaks inside brackets do not
+// end the logical line.
 func (l *Lexer) Tokenize() []Token {
-    for idx, raw := range l.lines {
-        lineNum := idx + 1
-        trimmed := strings.TrimSpace(raw)
+    for !l.atEnd() {
+        l.scanLine()
+    }
+    l.tokens = append(l.tokens, Token{Type: "EOF", Line: l.line, Column: l.column})
+    return l.tokens
+}
 
-        if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-            continue
-        }
+func (l *Lexer) scanLine() {
+    indent := 0
+    for !l.atEnd() && (l.peek() == ' ' || l.peek() == '\t') {
+        l.next()
+        indent++
+    }
 
-        indent := len(raw) - len(strings.TrimLeft(raw, " \t"))
-        if indent > 0 {
-            l.tokens = append(l.tokens, Token{Type: "INDENT", Value: strconv.Itoa(indent), Line: lineNum})
-        }
+    if l.atEnd() || l.peek() == '\n' || l.peek() == '\r' || l.peek() == '#' {
+        l.skipRestOfLine()
+        return
+    }
 
-        l.tokenizeLine(trimmed, lineNum)
-        l.tokens = append(l.tokens, Token{Type: "NEWLINE", Line: lineNum})
+    if indent > 0 {
+        l.tokens = append(l.tokens, Token{Type: "INDENT", Value: strconv.Itoa(indent), Line: l.line, Column: 1})
     }
 
-    l.tokens = append(l.tokens, Token{Type: "EOF", Line: len(l.lines)})
-    return l.tokens
+    for !l.atEnd() {
+        ch := l.peek()
+        switch {
+        case ch == '\n':
+            if l.depth > 0 && !l.nextLineStartsStatement() {
+                l.next()
+                continue
+            }
+            l.depth = 0
+            l.tokens = append(l.tokens, Token{Type: "NEWLINE", Line: l.line, Column: l.column})
+            l.next()
+            return
+        case ch == ' ' || ch == '\t' || ch == '\r':
+            l.next()
+        case ch == '#':
+            l.skipComment()
+        case ch == '"' || ch == '\'':
+            l.scanString()
+        case unicode.IsDigit(ch):
+            l.scanNumber()
+        case ch == '_' || unicode.IsLetter(ch):
+            l.scanWord()
+        default:
+            l.scanSymbol()
+        }
+    }
+
+    l.tokens = append(l.tokens, Token{Type: "NEWLINE", Line: l.line, Column: l.column})
 }
 
-func (l *Lexer) tokenizeLine(line string, lineNum int) {
-    switch {
-    case strings.HasPrefix(line, "task ") && strings.HasSuffix(line, ":"):
-        taskDef := strings.TrimSuffix(strings.TrimSpace(line[5:]), ":")
-        if strings.Contains(taskDef, " with ") {
-            parts := strings.SplitN(taskDef, " with ", 2)
-            name := strings.TrimSpace(parts[0])
-            params := splitCSV(parts[1])
-            l.tokens = append(l.tokens, Token{Type: "TASK", Value: name + "|" + strings.Join(params, ","), Line: lineNum})
-        } else {
-            l.tokens = append(l.tokens, Token{Type: "TASK", Value: taskDef, Line: lineNum})
+// scanString scans a quoted string. Triple-quoted strings may span lines.
+// Escape sequences are decoded; a string containing `{expr}` becomes a
+// TEMPLATE token carrying its undecoded text for the parser to split.
+func (l *Lexer) scanString() {
+    line, col := l.line, l.column
+    quote := string(l.peek())
+    if l.hasPrefix(strings.Repeat(quote, 3)) {
+        quote = strings.Repeat(quote, 3)
+    }
+    for range quote {
+        l.next()
+    }
+
+    start, rawLine, rawCol := l.pos, l.line, l.column
+    template := false
+    for !l.hasPrefix(quote) {
+        if l.atEnd() || (len(quote) == 1 && l.peek() == '\n') {
+            l.tokens = append(l.tokens, Token{Type: "UNKNOWN", Value: quote + string(l.source[start:l.pos]), Line: line, Column: col})
+            return
         }
+        switch l.peek() {
+        case '\\':
+            l.next()
+            if !l.atEnd() {
+                l.next()
+            }
+        case '{':
+            template = true
+            end, ok := interpolationEnd(l.source, l.pos, len(quote) == 3)
+            if !ok {
+                end = len(l.source)
+                if nl := indexRune(l.source, l.pos, '\n'); nl >= 0 && len(quote) == 1 {
+                    end = nl
+                }
+            }
+            for l.pos < end {
+                l.next()
+            }
+        default:
+            l.next()
+        }
+    }
+    raw := l.source[start:l.pos]
+    for range quote {
+        l.next()
+    }
+
+    if len(quote) == 3 && len(raw) > 0 && raw[0] == '\n' {
+        raw = raw[1:]
+        rawLine, rawCol = rawLine+1, 1
+    }
+    if template {
+        l.tokens = append(l.tokens, Token{Type: "TEMPLATE", Value: string(raw), Line: rawLine, Column: rawCol})
         return
-    case strings.HasPrefix(line, "greet "):
-        msg := strings.TrimSpace(line[len("greet "):])
-        l.tokens = append(l.tokens, Token{Type: "GREET", Value: msg, Line: lineNum})
-        return
-    case strings.HasPrefix(line, "backup ") && strings.Contains(line, " to "):
-        parts := strings.SplitN(strings.TrimSpace(line[len("backup "):]), " to ", 2)
-        l.tokens = append(l.tokens, Token{Type: "BACKUP", Value: parts[0]+"|"+parts[1], Line: lineNum})
-        return
-    case strings.HasPrefix(line, "check ") && strings.Contains(line, " -> "):
-        parts := strings.SplitN(strings.TrimSpace(line[len("check "):]), " -> ", 2)
-        l.tokens = append(l.tokens, Token{Type: "CHECK", Value: parts[0]+"|"+parts[1], Line: lineNum})
-        return
-    case strings.HasPrefix(line, "repeat ") && strings.HasSuffix(line, ":"):
-        if strings.Contains(line, " each ") && strings.Contains(line, " in ") {
-            re := regexp.MustCompile(`repeat each (\w+) in (.+):`)
-            if m := re.FindStringSubmatch(line); len(m) == 3 {
-                l.tokens = append(l.tokens, Token{Type: "REPEAT_EACH", Value: m[1]+"|"+strings.TrimSpace(m[2]), Line: lineNum})
-                return
+    }
+    l.tokens = append(l.tokens, Token{Type: "STRING", Value: unescape(raw), Line: line, Column: col})
+}
+
+// unescape decodes the escape sequences in raw string text. Unknown escapes
+// are kept as written, so Windows paths like "C:\Temp" still work.
+func unescape(raw []rune) string {
+    var sb strings.Builder
+    for idx := 0; idx < len(raw); idx++ {
+        if raw[idx] != '\\' || idx+1 == len(raw) {
+            sb.WriteRune(raw[idx])
+            continue
+        }
+        idx++
+        switch raw[idx] {
+        case 'n':
+            sb.WriteRune('\n')
+        case 't':
+            sb.WriteRune('\t')
+        case 'r':
+            sb.WriteRune('\r')
+        case '0':
+            sb.WriteRune(0)
+        case '\\', '"', '\'', '{', '}':
+            sb.WriteRune(raw[idx])
+        default:
+            sb.WriteRune('\\')
+            sb.WriteRune(raw[idx])
+        }
+    }
+    return sb.String()
+}
+
+// interpolationEnd returns the index just past the `}` closing the
+// interpolation that opens at src[open]. Braces and quoted strings inside
+// the expression are skipped over. ok is false if the interpolation is not
+// closed, or crosses a line break in a single-line string.
+func interpolationEnd(src []rune, open int, multiline bool) (end int, ok bool) {
+    depth := 0
+    for idx := open; idx < len(src); idx++ {
+        switch ch := src[idx]; ch {
+        case '\n':
+            if !multiline {
+                return idx, false
+            }
+        case '{':
+            depth++
+        case '}':
+            depth--
+            if depth == 0 {
+                return idx + 1, true
+            }
+        case '"', '\'':
+            for idx++; idx < len(src) && src[idx] != ch && src[idx] != '\n'; idx++ {
+                if src[idx] == '\\' {
+                    idx++
+                }
             }
         }
-        re := regexp.MustCompile(`repeat (\d+) times:`)
-        if m := re.FindStringSubmatch(line); len(m) == 2 {
-            l.tokens = append(l.tokens, Token{Type: "REPEAT_N", Value: m[1], Line: lineNum})
+    }
+    return len(src), false
+}
+
+func indexRune(src []rune, from int, r rune) int {
+    for idx := from; idx < len(src); idx++ {
+        if src[idx] == r {
+            return idx
+        }
+    }
+    return -1
+}
+
+func (l *Lexer) scanNumber() {
+    line, col := l.line, l.column
+    start := l.pos
+    for !l.atEnd() && unicode.IsDigit(l.peek()) {
+        l.next()
+    }
+    if l.peek() == '.' && unicode.IsDigit(l.peekAt(1)) {
+        l.next()
+        for !l.atEnd() && unicode.IsDigit(l.peek()) {
+            l.next()
+        }
+    }
+    l.tokens = append(l.tokens, Token{Type: "NUMBER", Value: string(l.source[start:l.pos]), Line: line, Column: col})
+}
+
+func (l *Lexer) scanWord() {
+    line, col := l.line, l.column
+    start := l.pos
+    for !l.atEnd() && (l.peek() == '_' || unicode.IsLetter(l.peek()) || unicode.IsDigit(l.peek())) {
+        l.next()
+    }
+    word := string(l.source[start:l.pos])
+    typ := "IDENT"
+    if keywords[word] {
+        typ = "KEYWORD"
+    }
+    l.tokens = append(l.tokens, Token{Type: typ, Value: word, Line: line, Column: col})
+}
+
+func (l *Lexer) scanSymbol() {
+    line, col := l.line, l.column
+    for _, op := range operators {
+        if l.hasPrefix(op) {
+            for range op {
+                l.next()
+            }
+            l.tokens = append(l.tokens, Token{Type: "OP", Value: op, Line: line, Column: col})
             return
         }
-    case strings.HasPrefix(line, "set ") && strings.Contains(line, " = "):
-        parts := strings.SplitN(strings.TrimSpace(line[len("set "):]), " = ", 2)
-        l.tokens = append(l.tokens, Token{Type: "SET", Value: parts[0]+"|"+parts[1], Line: lineNum})
-        return
-    case strings.HasPrefix(line, "run "):
-        rest := strings.TrimSpace(line[len("run "):])
-        if strings.HasPrefix(rest, "parallel ") {
-            tasks := strings.Split(strings.TrimSpace(rest[len("parallel "):]), ",")
-            l.tokens = append(l.tokens, Token{Type: "RUN_PARALLEL", Value: strings.Join(trimAll(tasks), ","), Line: lineNum})
-        } else {
-            l.tokens = append(l.tokens, Token{Type: "RUN", Value: rest, Line: lineNum})
+    }
+
+    ch := l.next()
+    switch ch {
+    case '(', '[', '{':
+        l.depth++
+    case ')', ']', '}':
+        if l.depth > 0 {
+            l.depth--
         }
-        return
-    case strings.HasPrefix(line, "use "):
-        l.tokens = append(l.tokens, Token{Type: "USE", Value: strings.TrimSpace(line[len("use "):]), Line: lineNum})
-        return
-    case line == "protect:":
-        l.tokens = append(l.tokens, Token{Type: "PROTECT", Line: lineNum})
-        return
-    case line == "handle:":
-        l.tokens = append(l.tokens, Token{Type: "HANDLE", Line: lineNum})
-        return
-    case strings.HasPrefix(line, "handle ") && strings.Contains(line, " -> "):
-        parts := strings.SplitN(strings.TrimSpace(line[len("handle "):]), " -> ", 2)
-        l.tokens = append(l.tokens, Token{Type: "HANDLE_INLINE", Value: parts[0]+"|"+parts[1], Line: lineNum})
-        return
-    case strings.HasPrefix(line, "return "):
-        l.tokens = append(l.tokens, Token{Type: "RETURN", Value: strings.TrimSpace(line[len("return "):]), Line: lineNum})
-        return
+    case ',', ':', '.':
     default:
-        l.tokens = append(l.tokens, Token{Type: "UNKNOWN", Value: line, Line: lineNum})
+        l.tokens = append(l.tokens, Token{Type: "UNKNOWN", Value: string(ch), Line: line, Column: col})
+        return
     }
+    l.tokens = append(l.tokens, Token{Type: "PUNCT", Value: string(ch), Line: line, Column: col})
 }
 
-// splitCSV splits a comma-separated list respecting simple spacing.
-func splitCSV(raw string) []string {
-    parts := strings.Split(raw, ",")
-    out := make([]string, 0, len(parts))
-    for _, p := range parts {
-        p = strings.TrimSpace(p)
-        if p != "" {
-            out = append(out, p)
-        }
+// nextLineStartsStatement reports whether the line after the current one
+// begins with a statement keyword. Inside an unclosed bracket this means the
+// bracket was never closed, and the line break should end the statement so
+// the rest of the file is not swallowed.
+func (l *Lexer) nextLineStartsStatement() bool {
+    idx := l.pos + 1
+    for idx < len(l.source) && (l.source[idx] == ' ' || l.source[idx] == '\t') {
+        idx++
+    }
+    start := idx
+    for idx < len(l.source) && (l.source[idx] == '_' || unicode.IsLetter(l.source[idx])) {
+        idx++
+    }
+    return statementKeywords[string(l.source[start:idx])]
+}
+
+func (l *Lexer) skipComment() {
+    for !l.atEnd() && l.peek() != '\n' {
+        l.next()
+    }
+}
+
+func (l *Lexer) skipRestOfLine() {
+    l.skipComment()
+    if !l.atEnd() {
+        l.next()
     }
-    return out
 }
 
-// trimAll trims whitespace from all items.
-func trimAll(in []string) []string {
-    out := make([]string, 0, len(in))
-    for _, v := range in {
-        if strings.TrimSpace(v) != "" {
-            out = append(out, strings.TrimSpace(v))
+func (l *Lexer) hasPrefix(s string) bool {
+    for idx, r := range []rune(s) {
+        if l.peekAt(idx) != r {
+            return false
         }
     }
-    return out
+    return true
+}
+
+func (l *Lexer) peek() rune {
+    return l.peekAt(0)
+}
+
+func (l *Lexer) peekAt(offset int) rune {
+    if l.pos+offset < len(l.source) {
+        return l.source[l.pos+offset]
+    }
+    return 0
+}
+
+func (l *Lexer) next() rune {
+    ch := l.source[l.pos]
+    l.pos++
+    if ch == '\n' {
+        l.line++
+        l.column = 1
+    } else {
+        l.column++
+    }
+    return ch
+}
+
+func (l *Lexer) atEnd() bool {
+    return l.pos >= len(l.source)
 }
@@ -0,0 +1,86 @@
+package lang
+
+// DefaultMaxIterations bounds the passes of a single loop unless configured
+// otherwise, so that a runaway loop fails instead of hanging.
+const DefaultMaxIterations = 1000000
+
+// SetMaxIterations limits how many times one loop may run its body before
+// an error is raised.
+func (i *Interpreter) SetMaxIterations(limit int) {
+    i.maxIterations = limit
+}
+
+// iterate runs one pass of a loop body. It reports the flow to hand back to
+// the enclosing block and whether the loop should stop.
+func (i *Interpreter) iterate(body []Node, bind map[string]Value) (flow, bool) {
+    i.checkContext()
+    switch f := i.executeScoped(body, bind); f {
+    case flowBreak:
+        return flowNext, true
+    case flowNext, flowContinue:
+        return flowNext, false
+    default:
+        return f, true
+    }
+}
+
+// checkIterations raises once the loop starting at line has completed the
+// maximum number of passes.
+func (i *Interpreter) checkIterations(done, line int) {
+    if done >= i.maxIterations {
+        i.line = line
+        i.raise(KindIterationLimit, "loop exceeded %d iterations", i.maxIterations)
+    }
+}
+
+// checkContext raises once the interpreter's context is canceled or past
+// its deadline.
+func (i *Interpreter) checkContext() {
+    if err := i.ctx.Err(); err != nil {
+        i.raise(errorKind(err), "execution stopped: %v", err)
+    }
+}
+
+func (i *Interpreter) executeRepeatN(node *RepeatNNode) flow {
+    countVal := i.evaluateExpression(node.Count)
+    count, ok := asInt(countVal)
+    if !ok {
+        if f, isNum := asNumber(countVal); isNum && f == float64(int(f)) {
+            count, ok = int(f), true
+        }
+    }
+    if !ok {
+        i.raise(KindType, "repeat count must be a whole number, got %s", typeName(countVal))
+    }
+    for idx := 0; idx < count; idx++ {
+        i.checkIterations(idx, node.Line)
+        if f, stop := i.iterate(node.Body, nil); stop {
+            return f
+        }
+    }
+    return flowNext
+}
+
+func (i *Interpreter) executeRepeatWhile(node *RepeatWhileNode) flow {
+    for idx := 0; i.evaluateCondition(node.Condition) != node.Until; idx++ {
+        i.checkIterations(idx, node.Line)
+        if f, stop := i.iterate(node.Body, nil); stop {
+            return f
+        }
+    }
+    return flowNext
+}
+
+func (i *Interpreter) executeRepeatEach(node *RepeatEachNode) flow {
+    listVal := i.evaluateExpression(node.List)
+    items, ok := listVal.([]Value)
+    if !ok {
+        i.raise(KindType, "repeat each expects a list, got %s", typeName(listVal))
+    }
+    for _, item := range items {
+        if f, stop := i.iterate(node.Body, map[string]Value{node.Var: item}); stop {
+            return f
+        }
+    }
+    return flowNext
+}
@@ -0,0 +1,327 @@
+package lang
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// ModulePathEnv names the environment variable listing extra folders to
+// search for modules, separated like PATH.
+const ModulePathEnv = "ATHERA_PATH"
+
+// PackagesDir is the folder of a project that `athera install` installs
+// packages into, one folder per package.
+const PackagesDir = "athera_modules"
+
+// namespace holds the tasks and globals of the main program or of one
+// module, so that modules cannot clash with each other's names.
+type namespace struct {
+    tasks   map[string]TaskDef
+    globals *scope
+}
+
+func newNamespace() *namespace {
+    return &namespace{tasks: make(map[string]TaskDef), globals: newScope(nil, true)}
+}
+
+// exports returns the tasks a module makes visible to its importers: those
+// marked export, or if none is, every task the module defines itself.
+// Tasks the module imported are not passed on.
+func (ns *namespace) exports() map[string]TaskDef {
+    exported := make(map[string]TaskDef)
+    for name, def := range ns.tasks {
+        if def.exported {
+            exported[name] = def
+        }
+    }
+    if len(exported) > 0 {
+        return exported
+    }
+    for name, def := range ns.tasks {
+        if !def.imported {
+            exported[name] = def
+        }
+    }
+    return exported
+}
+
+// qualifiedTask resolves a name such as `math_utils.square` to a task of
+// the module bound to `math_utils`.
+func (ns *namespace) qualifiedTask(name string) (*TaskRef, bool) {
+    dot := strings.LastIndex(name, ".")
+    if dot <= 0 {
+        return nil, false
+    }
+    module, ok := ns.globals.vars[name[:dot]].(map[string]Value)
+    if !ok {
+        return nil, false
+    }
+    ref, ok := module[name[dot+1:]].(*TaskRef)
+    return ref, ok
+}
+
+// switchNamespace makes ns the current namespace, so that task names and
+// globals resolve in it, and returns the namespace it replaced. A nil ns
+// leaves the current namespace in place.
+func (i *Interpreter) switchNamespace(ns *namespace) *namespace {
+    prev := i.ns
+    if ns == nil {
+        return prev
+    }
+    if local, ok := i.nsCopies[ns]; ok {
+        ns = local
+    }
+    i.ns, i.tasks, i.globals = ns, ns.tasks, ns.globals
+    return prev
+}
+
+// copyNamespace gives a parallel task's interpreter its own globals in
+// place of those of ns, sharing ns's tasks. Tasks defined in ns then run
+// against the copy.
+func (i *Interpreter) copyNamespace(ns *namespace) {
+    i.ns.tasks, i.tasks = ns.tasks, ns.tasks
+    i.nsCopies = map[*namespace]*namespace{ns: i.ns}
+}
+
+// executeUse imports a module: a stdlib module, or else the file
+// `name.ath` found on the module search path. A file module runs once, in
+// a namespace of its own; `use` then binds the module's exported tasks in
+// the importing namespace, as a dict under the module name or its alias,
+// or with `use a, b from name`, as the listed tasks themselves.
+func (i *Interpreter) executeUse(node *UseNode) {
+    name := strings.TrimSpace(node.Module)
+    if _, ok := StdlibModules[name]; ok {
+        i.modules[name] = true
+        fmt.Fprintf(i.stdout, "[Imported built-in module: %s]\n", name)
+        return
+    }
+
+    path, searched := i.findModule(name)
+    if path == "" {
+        i.raise(KindImport, "module '%s' not found (searched %s)", name, strings.Join(searched, ", "))
+    }
+    ns, seen := i.moduleFiles[path]
+    if seen && ns == nil {
+        i.raiseImportCycle(path)
+    }
+    if !seen {
+        ns = i.loadModule(name, path)
+    }
+
+    exports := ns.exports()
+    if node.Names != nil {
+        for _, task := range node.Names {
+            def, ok := exports[task]
+            if !ok {
+                i.raise(KindImport, "module '%s' does not export '%s'", name, task)
+            }
+            def.exported, def.imported = false, true
+            i.tasks[task] = def
+        }
+        return
+    }
+    module := make(map[string]Value, len(exports))
+    for task := range exports {
+        module[task] = &TaskRef{Name: task, ns: ns}
+    }
+    alias := node.Alias
+    if alias == "" {
+        alias = name
+    }
+    i.globals.vars[alias] = module
+}
+
+// moduleDirs lists the folders searched for the module name, in order:
+// the folder of the importing file, its modules folder, the installed
+// package name in the nearest athera_modules folder at or above it, every
+// other package installed there, the interpreter's module paths, then
+// each folder in ATHERA_PATH.
+func (i *Interpreter) moduleDirs(name string) []string {
+    base := "."
+    if i.file != "" && !strings.HasPrefix(i.file, "<") {
+        base = filepath.Dir(i.file)
+    }
+    dirs := []string{base, filepath.Join(base, "modules")}
+    pkg := findPackage(base, name)
+    if pkg != "" {
+        dirs = append(dirs, pkg)
+    }
+    for _, dir := range installedPackages(base) {
+        if dir != pkg {
+            dirs = append(dirs, dir)
+        }
+    }
+    dirs = append(dirs, i.modulePaths...)
+    for _, dir := range filepath.SplitList(os.Getenv(ModulePathEnv)) {
+        if dir != "" {
+            dirs = append(dirs, dir)
+        }
+    }
+    return dirs
+}
+
+// findPackage returns the folder of the installed package name in the
+// athera_modules folder of dir or of the nearest folder above it that has
+// the package, or "".
+func findPackage(dir, name string) string {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return ""
+    }
+    for {
+        pkg := filepath.Join(dir, PackagesDir, name)
+        if info, err := os.Stat(pkg); err == nil && info.IsDir() {
+            return pkg
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return ""
+        }
+        dir = parent
+    }
+}
+
+// installedPackages lists the package folders in the nearest
+// athera_modules folder at or above dir, in name order, so that a module
+// of any installed package can be used by its own name.
+func installedPackages(dir string) []string {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return nil
+    }
+    for {
+        root := filepath.Join(dir, PackagesDir)
+        if entries, err := os.ReadDir(root); err == nil {
+            var pkgs []string
+            for _, entry := range entries {
+                if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+                    pkgs = append(pkgs, filepath.Join(root, entry.Name()))
+                }
+            }
+            return pkgs
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return nil
+        }
+        dir = parent
+    }
+}
+
+// findModule returns the absolute path of the first `name.ath` on the
+// search path, or "" and the folders searched. The installed package of
+// the same name may instead provide its module as main.ath. A module found
+// in another installed package must be the only one of that name among
+// them; otherwise which one is used would depend on the packages' names.
+func (i *Interpreter) findModule(name string) (string, []string) {
+    dirs := i.moduleDirs(name)
+    for idx, dir := range dirs {
+        files := []string{name + ".ath"}
+        if isPackageDir(dir) && filepath.Base(dir) == name {
+            files = append(files, "main.ath")
+        }
+        for _, file := range files {
+            path := filepath.Join(dir, file)
+            if !isFile(path) {
+                continue
+            }
+            if isPackageDir(dir) && filepath.Base(dir) != name {
+                for _, other := range dirs[idx+1:] {
+                    if isPackageDir(other) && filepath.Dir(other) == filepath.Dir(dir) && isFile(filepath.Join(other, file)) {
+                        i.raise(KindImport, "module '%s' is provided by both installed packages '%s' and '%s'", name, filepath.Base(dir), filepath.Base(other))
+                    }
+                }
+            }
+            if abs, err := filepath.Abs(path); err == nil {
+                return abs, nil
+            }
+            return path, nil
+        }
+    }
+    return "", dirs
+}
+
+// isPackageDir reports whether dir is a package installed in an
+// athera_modules folder.
+func isPackageDir(dir string) bool {
+    return filepath.Base(filepath.Dir(dir)) == PackagesDir
+}
+
+func isFile(path string) bool {
+    info, err := os.Stat(path)
+    return err == nil && !info.IsDir()
+}
+
+// loadModule parses and runs a module file at the top level of a new
+// namespace, with errors reported against the module's own file, and
+// returns the namespace. While it runs, the module is marked as loading so
+// that a module importing it back is reported as a cycle.
+func (i *Interpreter) loadModule(name, path string) *namespace {
+    src, err := os.ReadFile(path)
+    if err != nil {
+        i.raise(errorKind(err), "use %s: %v", name, err)
+    }
+    prog, diags := Compile(path, string(src))
+    if len(diags) > 0 {
+        lines := make([]string, len(diags))
+        for idx, d := range diags {
+            lines[idx] = d.String()
+        }
+        i.raise(KindImport, "module '%s' has syntax errors:\n%s", name, strings.Join(lines, "\n"))
+    }
+
+    ns := newNamespace()
+    savedFile, savedLine, savedScope := i.file, i.line, i.current
+    savedNS := i.switchNamespace(ns)
+    i.moduleFiles[path] = nil
+    i.importing = append(i.importing, path)
+    defer func() {
+        i.switchNamespace(savedNS)
+        i.file, i.line, i.current = savedFile, savedLine, savedScope
+        i.importing = i.importing[:len(i.importing)-1]
+        if i.moduleFiles[path] == nil {
+            delete(i.moduleFiles, path)
+        }
+    }()
+
+    i.file, i.current = path, i.globals
+    if i.treeWalker {
+        i.executeBlock(prog.nodes)
+    } else {
+        i.runCode(prog.code)
+    }
+    i.moduleFiles[path] = ns
+    fmt.Fprintf(i.stdout, "[Imported module: %s]\n", name)
+    return ns
+}
+
+// enterProgram records the program file as loading, so that a module
+// importing it back is reported as a cycle.
+func (i *Interpreter) enterProgram(file string) {
+    if strings.HasPrefix(file, "<") {
+        return
+    }
+    if abs, err := filepath.Abs(file); err == nil {
+        i.moduleFiles[abs] = nil
+        i.importing = append(i.importing, abs)
+    }
+}
+
+// raiseImportCycle reports a module that is imported again while it is
+// still loading, naming every module in the cycle.
+func (i *Interpreter) raiseImportCycle(path string) {
+    start := 0
+    for idx, loading := range i.importing {
+        if loading == path {
+            start = idx
+        }
+    }
+    var names []string
+    for _, loading := range i.importing[start:] {
+        names = append(names, filepath.Base(loading))
+    }
+    names = append(names, filepath.Base(path))
+    i.raise(KindImport, "import cycle: %s", strings.Join(names, " -> "))
+}
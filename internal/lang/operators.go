@@ -0,0 +1,251 @@
+package lang
+
+import (
+    "fmt"
+    "math"
+)
+
+func negate(v Value) (Value, error) {
+    if n, ok := asInt(v); ok {
+        return -n, nil
+    }
+    if f, ok := asNumber(v); ok {
+        return -f, nil
+    }
+    return nil, typeError("cannot negate %s", typeName(v))
+}
+
+// binaryOp applies an arithmetic or comparison operator to two values.
+func binaryOp(op string, left, right Value) (Value, error) {
+    switch op {
+    case "==":
+        return valuesEqual(left, right), nil
+    case "!=":
+        return !valuesEqual(left, right), nil
+    case "<", "<=", ">", ">=":
+        cmp, err := compareValues(left, right)
+        if err != nil {
+            return nil, err
+        }
+        switch op {
+        case "<":
+            return cmp < 0, nil
+        case "<=":
+            return cmp <= 0, nil
+        case ">":
+            return cmp > 0, nil
+        }
+        return cmp >= 0, nil
+    case "+":
+        if ls, ok := left.(string); ok {
+            return ls + toString(right), nil
+        }
+        if rs, ok := right.(string); ok {
+            return toString(left) + rs, nil
+        }
+        if ll, ok := left.([]Value); ok {
+            if rl, ok := right.([]Value); ok {
+                return append(append([]Value{}, ll...), rl...), nil
+            }
+        }
+    }
+    return arithmetic(op, left, right)
+}
+
+func arithmetic(op string, left, right Value) (Value, error) {
+    li, lInt := asInt(left)
+    ri, rInt := asInt(right)
+    if lInt && rInt {
+        switch op {
+        case "+":
+            return li + ri, nil
+        case "-":
+            return li - ri, nil
+        case "*":
+            return li * ri, nil
+        case "/":
+            if ri == 0 {
+                return nil, errDivisionByZero
+            }
+            if li%ri == 0 {
+                return li / ri, nil
+            }
+            return float64(li) / float64(ri), nil
+        case "%":
+            if ri == 0 {
+                return nil, errDivisionByZero
+            }
+            return li % ri, nil
+        }
+    }
+
+    lf, lNum := asNumber(left)
+    rf, rNum := asNumber(right)
+    if !lNum || !rNum {
+        return nil, typeError("unsupported operand types for %s: %s and %s", op, typeName(left), typeName(right))
+    }
+    switch op {
+    case "+":
+        return lf + rf, nil
+    case "-":
+        return lf - rf, nil
+    case "*":
+        return lf * rf, nil
+    case "/":
+        if rf == 0 {
+            return nil, errDivisionByZero
+        }
+        return lf / rf, nil
+    case "%":
+        if rf == 0 {
+            return nil, errDivisionByZero
+        }
+        return math.Mod(lf, rf), nil
+    }
+    return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// memberOf reads a built-in property or dict key from a value.
+func memberOf(obj Value, name string) (Value, error) {
+    switch v := obj.(type) {
+    case map[string]Value:
+        return v[name], nil
+    case *RuntimeError:
+        switch name {
+        case "message":
+            return v.Message, nil
+        case "kind":
+            return v.Kind, nil
+        case "line":
+            return v.Line, nil
+        }
+    case string:
+        switch name {
+        case "length":
+            return len([]rune(v)), nil
+        case "is_empty":
+            return v == "", nil
+        }
+    case []Value:
+        switch name {
+        case "length":
+            return len(v), nil
+        case "is_empty":
+            return len(v) == 0, nil
+        }
+    }
+    return nil, typeError("%s has no property %s", typeName(obj), name)
+}
+
+// indexOf reads element idx of a list or string, counting from the end
+// when idx is negative, or the entry for key idx of a dict.
+func indexOf(obj, idx Value) (Value, error) {
+    if d, ok := obj.(map[string]Value); ok {
+        key, ok := idx.(string)
+        if !ok {
+            return nil, typeError("dict keys are strings, got %s", typeName(idx))
+        }
+        return d[key], nil
+    }
+    n, ok := asInt(idx)
+    if !ok {
+        return nil, typeError("index must be an integer, got %s", typeName(idx))
+    }
+    switch v := obj.(type) {
+    case []Value:
+        if k, ok := resolveIndex(n, len(v)); ok {
+            return v[k], nil
+        }
+    case string:
+        runes := []rune(v)
+        if k, ok := resolveIndex(n, len(runes)); ok {
+            return string(runes[k]), nil
+        }
+    default:
+        return nil, typeError("cannot index %s", typeName(obj))
+    }
+    return nil, indexError("index %d out of range", n)
+}
+
+// resolveIndex maps a possibly negative index onto [0, length).
+func resolveIndex(n, length int) (int, bool) {
+    if n < 0 {
+        n += length
+    }
+    return n, n >= 0 && n < length
+}
+
+// sliceOf returns elements start up to but not including end of a list or
+// string. Nil bounds mean the beginning and end; negative bounds count from
+// the end, and bounds past either end are clamped as in Python.
+func sliceOf(obj, start, end Value) (Value, error) {
+    var length int
+    switch v := obj.(type) {
+    case []Value:
+        length = len(v)
+    case string:
+        length = len([]rune(v))
+    default:
+        return nil, typeError("cannot slice %s", typeName(obj))
+    }
+
+    from, err := sliceBound(start, 0, length)
+    if err != nil {
+        return nil, err
+    }
+    to, err := sliceBound(end, length, length)
+    if err != nil {
+        return nil, err
+    }
+    to = max(to, from)
+
+    switch v := obj.(type) {
+    case []Value:
+        return append([]Value{}, v[from:to]...), nil
+    default:
+        return string([]rune(v.(string))[from:to]), nil
+    }
+}
+
+func sliceBound(bound Value, fallback, length int) (int, error) {
+    if bound == nil {
+        return fallback, nil
+    }
+    n, ok := asInt(bound)
+    if !ok {
+        return 0, typeError("slice bounds must be integers, got %s", typeName(bound))
+    }
+    if n < 0 {
+        n += length
+    }
+    return min(max(n, 0), length), nil
+}
+
+// setIndex stores val under key idx of a dict, or at element idx of a list.
+func setIndex(obj, idx, val Value) error {
+    if d, ok := obj.(map[string]Value); ok {
+        key, ok := idx.(string)
+        if !ok {
+            return typeError("dict keys are strings, got %s", typeName(idx))
+        }
+        d[key] = val
+        return nil
+    }
+    n, ok := asInt(idx)
+    if !ok {
+        if _, isName := idx.(string); isName {
+            return typeError("cannot set property %s of %s", idx, typeName(obj))
+        }
+        return typeError("index must be an integer, got %s", typeName(idx))
+    }
+    switch v := obj.(type) {
+    case []Value:
+        if k, ok := resolveIndex(n, len(v)); ok {
+            v[k] = val
+            return nil
+        }
+    default:
+        return typeError("cannot assign to an element of %s", typeName(obj))
+    }
+    return indexError("index %d out of range", n)
+}
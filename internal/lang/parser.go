@@ -1,33 +1,119 @@
 package lang
 
 import (
+    "fmt"
+    "sort"
     "strconv"
     "strings"
 )
 
+// statementKeywords lists the keywords that may begin a statement.
+var statementKeywords = map[string]bool{
+    "task":     true,
+    "greet":    true,
+    "backup":   true,
+    "check":    true,
+    "repeat":   true,
+    "set":      true,
+    "run":      true,
+    "use":      true,
+    "export":   true,
+    "protect":  true,
+    "handle":   true,
+    "return":   true,
+    "global":   true,
+    "raise":    true,
+    "if":       true,
+    "else":     true,
+    "break":    true,
+    "continue": true,
+}
+
+// blockKeywords start statements that open an indented block, or belong
+// to one, so they cannot follow `->` as an inline action.
+var blockKeywords = map[string]bool{
+    "repeat":  true,
+    "protect": true,
+    "handle":  true,
+    "task":    true,
+    "export":  true,
+    "if":      true,
+    "else":    true,
+}
+
 // Parser builds an AST from tokens.
 type Parser struct {
-    tokens []Token
-    pos    int
+    tokens      []Token
+    pos         int
+    inCommand   bool
+    loops       int
+    file        string
+    lines       []string
+    diagnostics []Diagnostic
+    errorLines  map[int]bool
 }
 
 // NewParser constructs a parser for tokens.
 func NewParser(tokens []Token) *Parser {
-    return &Parser{tokens: tokens}
+    return &Parser{tokens: tokens, errorLines: make(map[int]bool)}
 }
 
-// Parse converts tokens into a slice of AST nodes.
-func (p *Parser) Parse() []Node {
+// ParseSource lexes and parses src, attributing diagnostics to file.
+func ParseSource(file, src string) ([]Node, []Diagnostic) {
+    p := NewParser(NewLexer(src).Tokenize())
+    p.file = file
+    p.lines = strings.Split(src, "\n")
+    return p.Parse()
+}
+
+// Parse converts tokens into a slice of AST nodes. Syntax errors are
+// collected as diagnostics; parsing resumes at the next line so that every
+// error in the program is reported at once.
+func (p *Parser) Parse() ([]Node, []Diagnostic) {
+    for _, tok := range p.tokens {
+        if tok.Type == "UNKNOWN" {
+            if strings.HasPrefix(tok.Value, "\"") || strings.HasPrefix(tok.Value, "'") {
+                p.errorAt(tok, "unterminated string")
+            } else {
+                p.errorAt(tok, "unexpected character %s", describeToken(tok))
+            }
+        }
+    }
+
     var nodes []Node
     for !p.isAtEnd() {
-        if node := p.parseStatement(0); node != nil {
+        if node := p.parseStatement(); node != nil {
             nodes = append(nodes, node)
         }
     }
-    return nodes
+
+    sort.SliceStable(p.diagnostics, func(a, b int) bool {
+        da, db := p.diagnostics[a], p.diagnostics[b]
+        if da.Line != db.Line {
+            return da.Line < db.Line
+        }
+        return da.Column < db.Column
+    })
+    return nodes, p.diagnostics
+}
+
+// errorAt records a diagnostic at tok. Only the first error on a line is
+// kept, since later ones are usually knock-on effects of it.
+func (p *Parser) errorAt(tok Token, format string, args ...any) {
+    if p.errorLines[tok.Line] {
+        return
+    }
+    p.errorLines[tok.Line] = true
+    p.diagnostics = append(p.diagnostics, Diagnostic{
+        File:    p.file,
+        Line:    tok.Line,
+        Column:  tok.Column,
+        Message: fmt.Sprintf(format, args...),
+        Excerpt: sourceExcerpt(p.lines, tok.Line, tok.Column),
+    })
 }
 
-func (p *Parser) parseStatement(parentIndent int) Node {
+func (p *Parser) parseStatement() Node {
     tok := p.peek()
 
     if tok.Type == "NEWLINE" {
@@ -39,253 +125,675 @@ func (p *Parser) parseStatement(parentIndent int) Node {
     }
 
     if tok.Type == "INDENT" {
-        indent, _ := strconv.Atoi(tok.Value)
-        if indent <= parentIndent {
+        p.advance()
+    }
+
+    if p.checkKeyword("task") {
+        return withPos(p.parseTask(p.peek()), tok)
+    }
+    if p.checkKeyword("export") {
+        head := p.advance()
+        if !p.checkKeyword("task") {
+            p.errorAt(p.peek(), "expected a task after export, found %s", describeToken(p.peek()))
+            p.skipLine()
             return nil
         }
-        p.advance()
-        tok = p.peek()
+        task := p.parseTask(head).(*TaskNode)
+        task.Exported = true
+        return withPos(task, tok)
     }
+    return p.parseBlockStatement()
+}
 
-    switch tok.Type {
-    case "TASK":
-        return p.parseTask()
-    case "GREET":
-        return p.parseGreet()
-    case "BACKUP":
-        return p.parseBackup()
-    case "CHECK":
-        return p.parseCheck()
-    case "REPEAT_N":
-        return p.parseRepeatN()
-    case "REPEAT_EACH":
-        return p.parseRepeatEach()
-    case "SET":
-        return p.parseSet()
-    case "RUN":
-        return p.parseRun()
-    case "USE":
-        return p.parseUse()
-    case "PROTECT":
-        return p.parseProtect()
-    case "HANDLE_INLINE":
-        return p.parseHandleInline()
-    case "RUN_PARALLEL":
-        return p.parseRunParallel()
-    case "RETURN":
-        return p.parseReturn()
-    default:
-        p.advance()
-        return nil
+// withPos stamps a parsed statement with the token it started at.
+func withPos(node Node, tok Token) Node {
+    if n, ok := node.(interface{ setPos(Pos) }); ok {
+        n.setPos(posOf(tok))
     }
+    return node
 }
 
-func (p *Parser) parseTask() Node {
-    tok := p.advance()
-    val := tok.Value
-    name := val
-    var params []string
+// parseTask parses a task definition. head is the first token of the
+// line, `task` or `export`, which the body is indented from.
+func (p *Parser) parseTask(head Token) Node {
+    p.advance() // consume task
+    nameTok, _ := p.expectIdent("a task name")
+    var params []Param
+    if p.matchKeyword("with") {
+        params = p.parseParams()
+    }
+    var returns string
+    if p.matchOp("->") {
+        returns = p.parseTypeName()
+    }
+
+    body := p.parseBlockHeader(head)
+    return &TaskNode{Name: nameTok.Value, Params: params, Returns: returns, Body: body}
+}
+
+// parseParams parses the parameter list after `with`, such as
+// `name: string, greeting = "Hi", ...rest`. Parameters with defaults must
+// follow those without, and a rest parameter must come last.
+func (p *Parser) parseParams() []Param {
+    var params []Param
+    seen := make(map[string]bool)
+    for {
+        rest := p.matchOp("...")
+        nameTok, ok := p.expectIdent("a parameter name")
+        if !ok {
+            break
+        }
+        param := Param{Name: nameTok.Value, Rest: rest}
+        if isPunct(p.peek(), ":") && !isLineEnd(p.peekAhead(1)) {
+            p.advance()
+            param.Type = p.parseTypeName()
+        }
+        if !rest && p.matchOp("=") {
+            param.Default = p.parseNested()
+        }
 
-    if strings.Contains(val, "|") {
-        parts := strings.SplitN(val, "|", 2)
-        name = parts[0]
-        if len(parts) > 1 && parts[1] != "" {
-            params = splitCSV(parts[1])
+        switch {
+        case seen[param.Name]:
+            p.errorAt(nameTok, "duplicate parameter '%s'", param.Name)
+        case len(params) > 0 && params[len(params)-1].Rest:
+            p.errorAt(nameTok, "parameter '%s' follows rest parameter '%s'", param.Name, params[len(params)-1].Name)
+        case !rest && param.Default == nil && len(params) > 0 && params[len(params)-1].Default != nil:
+            p.errorAt(nameTok, "parameter '%s' needs a default because '%s' has one", param.Name, params[len(params)-1].Name)
+        }
+        seen[param.Name] = true
+        params = append(params, param)
+        if !p.matchPunct(",") {
+            break
         }
     }
+    return params
+}
 
-    p.consume("NEWLINE")
-    body := p.parseBlock()
-    return &TaskNode{Name: name, Params: params, Body: body}
+// parseTypeName reads the type name of an annotation.
+func (p *Parser) parseTypeName() string {
+    tok := p.peek()
+    if tok.Type != "IDENT" && tok.Type != "KEYWORD" {
+        p.errorAt(tok, "expected a type name, found %s", describeToken(tok))
+        return ""
+    }
+    p.advance()
+    if _, ok := typeNames[tok.Value]; !ok {
+        p.errorAt(tok, "unknown type %q", tok.Value)
+        return ""
+    }
+    return tok.Value
 }
 
-func (p *Parser) parseBlock() []Node {
+// parseBlockHeader finishes a `...:` header line and parses its block.
+func (p *Parser) parseBlockHeader(head Token) []Node {
+    if p.expectPunct(":") {
+        p.expectLineEnd()
+    } else {
+        p.skipLine()
+    }
+    return p.parseBlock(head)
+}
+
+// parseBlock parses the lines indented deeper than the header token.
+func (p *Parser) parseBlock(head Token) []Node {
+    parent := head.Column - 1
+    base := -1
     var body []Node
-    var baseIndent *int
 
     for !p.isAtEnd() {
         tok := p.peek()
-
-        if tok.Type == "INDENT" {
-            indent, _ := strconv.Atoi(tok.Value)
-            if baseIndent == nil {
-                baseIndent = &indent
-            } else if indent < *baseIndent {
-                break
-            }
-            p.advance()
-            tok = p.peek()
-        } else if tok.Type == "NEWLINE" {
+        if tok.Type == "NEWLINE" {
             p.advance()
             continue
-        } else {
-            if baseIndent != nil {
-                break
-            }
         }
 
-        node := p.parseBlockStatement()
-        if node != nil {
+        indent := 0
+        if tok.Type == "INDENT" {
+            indent, _ = strconv.Atoi(tok.Value)
+        }
+        if indent <= parent {
+            break
+        }
+        if base == -1 {
+            base = indent
+        } else if indent < base {
+            p.errorAt(tok, "unindent does not match any outer indentation level")
+        }
+
+        p.advance()
+        if node := p.parseBlockStatement(); node != nil {
             body = append(body, node)
         }
     }
 
+    if base == -1 {
+        p.errorAt(head, "expected an indented block after %q", head.Value)
+    }
     return body
 }
 
 func (p *Parser) parseBlockStatement() Node {
+    tok := p.peek()
+    return withPos(p.parseStatementKind(), tok)
+}
+
+func (p *Parser) parseStatementKind() Node {
     tok := p.peek()
     var node Node
 
-    switch tok.Type {
-    case "GREET":
+    if tok.Type == "IDENT" {
+        return p.parseExprStatement()
+    }
+    if tok.Type != "KEYWORD" {
+        p.errorAt(tok, "expected a statement, found %s", describeToken(tok))
+        p.skipLine()
+        return nil
+    }
+
+    switch tok.Value {
+    case "repeat":
+        return p.parseRepeat()
+    case "protect":
+        return p.parseProtect()
+    case "if":
+        return p.parseIf()
+    case "else":
+        p.errorAt(tok, "else without a preceding if block")
+        p.skipLine()
+        return nil
+    case "check":
+        return p.parseCheck()
+    case "task", "export":
+        p.errorAt(tok, "tasks can only be defined at the top level")
+        p.skipLine()
+        return nil
+    case "greet":
         node = p.parseGreet()
-    case "BACKUP":
+    case "backup":
         node = p.parseBackup()
-    case "CHECK":
-        node = p.parseCheck()
-    case "REPEAT_N":
-        node = p.parseRepeatN()
-    case "REPEAT_EACH":
-        node = p.parseRepeatEach()
-    case "SET":
+    case "set":
         node = p.parseSet()
-    case "RUN":
-        node = p.parseRun()
-    case "RUN_PARALLEL":
-        node = p.parseRunParallel()
-    case "USE":
+    case "run":
+        if isKeyword(p.peekAhead(1), "parallel") {
+            node = p.parseRunParallel()
+        } else {
+            node = p.parseRun()
+        }
+    case "use":
         node = p.parseUse()
-    case "PROTECT":
-        node = p.parseProtect()
-    case "HANDLE_INLINE":
-        node = p.parseHandleInline()
-    case "RETURN":
+    case "handle":
+        p.errorAt(tok, "handle without a preceding protect: block")
+        p.skipLine()
+        return nil
+    case "raise":
+        node = p.parseRaise()
+    case "break", "continue":
+        node = p.parseLoopControl()
+    case "return":
         node = p.parseReturn()
+    case "global":
+        node = p.parseGlobal()
     default:
-        p.advance()
+        p.errorAt(tok, "expected a statement, found %s", describeToken(tok))
+        p.skipLine()
         return nil
     }
 
-    p.consume("NEWLINE")
+    p.expectLineEnd()
     return node
 }
 
+// parseExprStatement parses a line that starts with a name. Only calls are
+// allowed here; anything else is most likely a misspelled keyword.
+func (p *Parser) parseExprStatement() Node {
+    tok := p.peek()
+    expr := p.parseExpression()
+    if _, ok := expr.(*CallExpr); !ok && !isModuleMember(expr) {
+        if hint := suggestKeyword(tok.Value); hint != "" {
+            p.errorAt(tok, "unknown statement %q (did you mean %q?)", tok.Value, hint)
+        } else {
+            p.errorAt(tok, "unknown statement %q", tok.Value)
+        }
+        p.skipLine()
+        return nil
+    }
+    p.expectLineEnd()
+    return &ExprNode{Expr: expr}
+}
+
 func (p *Parser) parseGreet() Node {
-    tok := p.advance()
-    return &GreetNode{Message: tok.Value}
+    p.advance() // consume greet
+    return &GreetNode{Message: p.parseRequiredExpression("a message")}
 }
 
 func (p *Parser) parseBackup() Node {
-    tok := p.advance()
-    parts := strings.SplitN(tok.Value, "|", 2)
-    src, dest := parts[0], ""
-    if len(parts) > 1 {
-        dest = parts[1]
-    }
+    p.advance() // consume backup
+    src := p.parseRequiredExpression("a source path")
+    p.expectKeyword("to")
+    dest := p.parseRequiredExpression("a destination path")
     return &BackupNode{Source: src, Dest: dest}
 }
 
 func (p *Parser) parseCheck() Node {
-    tok := p.advance()
-    parts := strings.SplitN(tok.Value, "|", 2)
-    cond, action := parts[0], ""
-    if len(parts) > 1 {
-        action = parts[1]
+    p.advance() // consume check
+    cond := p.parseRequiredExpression("a condition")
+    p.expectOp("->")
+    return &CheckNode{Condition: cond, Action: p.parseAction()}
+}
+
+func (p *Parser) parseRepeat() Node {
+    head := p.advance() // consume repeat
+
+    switch {
+    case p.matchKeyword("each"):
+        varTok, _ := p.expectIdent("a loop variable")
+        p.expectKeyword("in")
+        list := p.parseRequiredExpression("a list")
+        return &RepeatEachNode{Var: varTok.Value, List: list, Body: p.parseLoopBody(head)}
+    case p.checkKeyword("while"), p.checkKeyword("until"):
+        until := p.advance().Value == "until"
+        cond := p.parseRequiredExpression("a condition")
+        return &RepeatWhileNode{Condition: cond, Until: until, Body: p.parseLoopBody(head)}
+    }
+
+    var count Expr
+    if countTok := p.peek(); p.startsOperand() {
+        count = p.parseExpression()
+        p.expectKeyword("times")
+    } else {
+        p.errorAt(countTok, "expected a count, \"each\", \"while\" or \"until\" after repeat, found %s", describeToken(countTok))
     }
-    return &CheckNode{Condition: cond, Action: action}
+    return &RepeatNNode{Count: count, Body: p.parseLoopBody(head)}
 }
 
-func (p *Parser) parseRepeatN() Node {
-    tok := p.advance()
-    count, _ := strconv.Atoi(tok.Value)
-    p.consume("NEWLINE")
-    body := p.parseBlock()
-    return &RepeatNNode{Count: count, Body: body}
+// parseLoopBody parses a loop's block, inside which break and continue
+// are allowed.
+func (p *Parser) parseLoopBody(head Token) []Node {
+    p.loops++
+    defer func() { p.loops-- }()
+    return p.parseBlockHeader(head)
 }
 
-func (p *Parser) parseRepeatEach() Node {
-    tok := p.advance()
-    parts := strings.SplitN(tok.Value, "|", 2)
-    varName, listExpr := parts[0], ""
-    if len(parts) > 1 {
-        listExpr = parts[1]
+func (p *Parser) parseLoopControl() Node {
+    tok := p.advance() // consume break or continue
+    if p.loops == 0 {
+        p.errorAt(tok, "%s outside of a loop", tok.Value)
     }
-    p.consume("NEWLINE")
-    body := p.parseBlock()
-    return &RepeatEachNode{Var: varName, ListExpr: listExpr, Body: body}
+    if tok.Value == "break" {
+        return &BreakNode{}
+    }
+    return &ContinueNode{}
 }
 
 func (p *Parser) parseSet() Node {
-    tok := p.advance()
-    parts := strings.SplitN(tok.Value, "|", 2)
-    name, value := parts[0], ""
-    if len(parts) > 1 {
-        value = parts[1]
+    p.advance() // consume set
+    nameTok, _ := p.expectIdent("a variable name")
+    node := &SetNode{Var: nameTok.Value}
+    if p.matchPunct(":") {
+        node.Type = p.parseTypeName()
     }
-    return &SetNode{Var: name, Value: value}
+
+    var target Expr = &IdentExpr{Pos: posOf(nameTok), Name: nameTok.Value}
+    for {
+        at := posOf(p.peek())
+        if p.matchPunct(".") {
+            target = &MemberExpr{Pos: posOf(p.peek()), Object: target, Name: p.expectMemberName()}
+        } else if p.matchPunct("[") {
+            target = &IndexExpr{Pos: at, Object: target, Index: p.parseNested()}
+            p.expectPunct("]")
+        } else {
+            break
+        }
+        node.Target = target
+    }
+
+    if node.Type != "" && node.Target != nil {
+        p.errorAt(nameTok, "a type annotation applies to a whole variable, not to an element of it")
+    }
+
+    p.expectOp("=")
+    node.Value = p.parseRequiredExpression("a value")
+    return node
 }
 
 func (p *Parser) parseRun() Node {
-    tok := p.advance()
-    return &RunNode{Target: tok.Value}
+    p.advance() // consume run
+    nameTok, _ := p.expectIdent("a task name")
+    name := nameTok.Value
+    for p.matchPunct(".") {
+        part, _ := p.expectIdent("a task name")
+        name += "." + part.Value
+    }
+    args, named := p.parseCommandArgs()
+    return &RunNode{Task: name, Args: args, Named: named}
 }
 
+// parseUse parses `use module`, `use module as alias` or
+// `use name, other from module`. The words `as` and `from` are only special
+// here, so they stay usable as variable names.
 func (p *Parser) parseUse() Node {
-    tok := p.advance()
-    return &UseNode{Module: tok.Value}
+    p.advance() // consume use
+    nameTok, _ := p.expectIdent("a module name")
+    names := []string{nameTok.Value}
+    for p.matchPunct(",") {
+        tok, ok := p.expectIdent("a task name")
+        if !ok {
+            return nil
+        }
+        names = append(names, tok.Value)
+    }
+
+    node := &UseNode{Module: nameTok.Value}
+    switch next := p.peek(); {
+    case isWord(next, "from"):
+        p.advance()
+        moduleTok, ok := p.expectIdent("a module name")
+        if !ok {
+            return nil
+        }
+        node.Module, node.Names = moduleTok.Value, names
+    case len(names) > 1:
+        p.errorAt(next, "expected \"from\" after the task names, found %s", describeToken(next))
+        return nil
+    case isWord(next, "as"):
+        p.advance()
+        aliasTok, ok := p.expectIdent("a name for the module")
+        if !ok {
+            return nil
+        }
+        node.Alias = aliasTok.Value
+    }
+    if _, builtin := StdlibModules[node.Module]; builtin && (node.Alias != "" || node.Names != nil) {
+        p.errorAt(nameTok, "built-in module %s cannot be renamed or imported from", node.Module)
+    }
+    return node
+}
+
+// isWord reports whether tok is the plain word w.
+func isWord(tok Token, w string) bool {
+    return tok.Type == "IDENT" && tok.Value == w
 }
 
 func (p *Parser) parseProtect() Node {
-    p.advance() // consume protect
-    p.consume("NEWLINE")
+    head := p.advance() // consume protect
+    protectBody := p.parseBlockHeader(head)
 
-    var protectBody []Node
-    for !p.isAtEnd() {
-        tok := p.peek()
-        if tok.Type == "HANDLE" || (tok.Type == "INDENT" && p.peekAhead(1).Type == "HANDLE") {
-            break
-        }
-        if tok.Type == "INDENT" {
+    var handlers []Node
+    catchAll := false
+    for p.atClause(head.Column-1, "handle") {
+        if p.peek().Type == "INDENT" {
             p.advance()
         }
-        if node := p.parseBlockStatement(); node != nil {
-            protectBody = append(protectBody, node)
+        handleTok := p.peek()
+        clause := p.parseHandleClause()
+        if catchAll {
+            p.errorAt(handleTok, "handle clause after a catch-all handle is never reached")
         }
+        if clauseKind(clause) == "" {
+            catchAll = true
+        }
+        handlers = append(handlers, withPos(clause, handleTok))
     }
 
-    var handleBody []Node
-    if p.peek().Type == "HANDLE" || (p.peek().Type == "INDENT" && p.peekAhead(1).Type == "HANDLE") {
-        if p.peek().Type == "INDENT" {
-            p.advance()
+    return &ProtectNode{Protect: protectBody, Handlers: handlers}
+}
+
+// atClause reports whether the next line is a clause starting with keyword
+// at the given indentation, such as `handle` after `protect`.
+func (p *Parser) atClause(indent int, keyword string) bool {
+    offset := 0
+    if tok := p.peek(); tok.Type == "INDENT" {
+        if n, _ := strconv.Atoi(tok.Value); n != indent {
+            return false
         }
-        p.consume("HANDLE")
-        p.consume("NEWLINE")
-        handleBody = p.parseBlock()
+        offset = 1
+    } else if indent != 0 {
+        return false
     }
+    return isKeyword(p.peekAhead(offset), keyword)
+}
 
-    return &ProtectNode{Protect: protectBody, Handle: handleBody}
+// parseHandleClause parses `handle [Kind]:` followed by a block, or
+// `handle [Kind] -> action`.
+func (p *Parser) parseHandleClause() Node {
+    head := p.advance() // consume handle
+    kind := ""
+    if p.peek().Type == "IDENT" {
+        kind = p.advance().Value
+    }
+    if p.matchOp("->") {
+        return &HandleInlineNode{ErrorType: kind, Action: p.parseAction()}
+    }
+    if !isPunct(p.peek(), ":") {
+        p.errorAt(p.peek(), "expected an error kind, \":\" or \"->\" after handle, found %s", describeToken(p.peek()))
+        p.skipLine()
+        return &HandleBlockNode{ErrorType: kind}
+    }
+    return &HandleBlockNode{ErrorType: kind, Body: p.parseBlockHeader(head)}
 }
 
-func (p *Parser) parseHandleInline() Node {
-    tok := p.advance()
-    parts := strings.SplitN(tok.Value, "|", 2)
-    errType, action := parts[0], ""
-    if len(parts) > 1 {
-        action = parts[1]
+func clauseKind(clause Node) string {
+    switch c := clause.(type) {
+    case *HandleBlockNode:
+        return c.ErrorType
+    case *HandleInlineNode:
+        return c.ErrorType
     }
-    return &HandleInlineNode{ErrorType: errType, Action: action}
+    return ""
+}
+
+// parseRaise parses `raise [Kind] [message]`. Without a kind the error is a
+// UserError; without a message the kind doubles as the message.
+func (p *Parser) parseRaise() Node {
+    p.advance() // consume raise
+    if tok := p.peek(); isLineEnd(tok) {
+        p.errorAt(tok, "expected an error kind or message after raise")
+        return &RaiseNode{}
+    }
+    // A leading name is the kind unless it is the start of the message
+    // expression itself, as in `raise error.message`.
+    kind := ""
+    if next := p.peekAhead(1); p.peek().Type == "IDENT" && next.Type != "OP" && next.Type != "PUNCT" {
+        kind = p.advance().Value
+    }
+    if isLineEnd(p.peek()) {
+        return &RaiseNode{Kind: kind}
+    }
+    return &RaiseNode{Kind: kind, Message: p.parseExpression()}
+}
+
+// parseIf parses an `if cond:` block followed by any number of
+// `else if cond:` blocks and an optional final `else:` block.
+func (p *Parser) parseIf() Node {
+    head := p.advance() // consume if
+    node := &IfNode{}
+    node.Branches = append(node.Branches, IfBranch{
+        Condition: p.parseRequiredExpression("a condition"),
+        Body:      p.parseBlockHeader(head),
+    })
+
+    for p.atClause(head.Column-1, "else") {
+        if p.peek().Type == "INDENT" {
+            p.advance()
+        }
+        elseTok := p.advance() // consume else
+        if p.matchKeyword("if") {
+            node.Branches = append(node.Branches, IfBranch{
+                Condition: p.parseRequiredExpression("a condition"),
+                Body:      p.parseBlockHeader(elseTok),
+            })
+            continue
+        }
+        node.Else = p.parseBlockHeader(elseTok)
+        break
+    }
+    return node
 }
 
 func (p *Parser) parseRunParallel() Node {
-    tok := p.advance()
-    tasks := splitCSV(tok.Value)
+    p.advance() // consume run
+    p.advance() // consume parallel
+    var tasks []string
+    for {
+        tok, ok := p.expectIdent("a task name")
+        if !ok {
+            break
+        }
+        tasks = append(tasks, tok.Value)
+        if !p.matchPunct(",") {
+            break
+        }
+    }
     return &RunParallelNode{Tasks: tasks}
 }
 
 func (p *Parser) parseReturn() Node {
-    tok := p.advance()
-    return &ReturnNode{Expr: tok.Value}
+    p.advance() // consume return
+    if isLineEnd(p.peek()) {
+        return &ReturnNode{}
+    }
+    return &ReturnNode{Value: p.parseExpression()}
+}
+
+func (p *Parser) parseGlobal() Node {
+    p.advance() // consume global
+    var names []string
+    for {
+        tok, ok := p.expectIdent("a variable name")
+        if !ok {
+            break
+        }
+        names = append(names, tok.Value)
+        if !p.matchPunct(",") {
+            break
+        }
+    }
+    return &GlobalNode{Names: names}
+}
+
+// parseRequiredExpression parses an expression, reporting what was expected
+// when the line ends early.
+func (p *Parser) parseRequiredExpression(what string) Expr {
+    if tok := p.peek(); isLineEnd(tok) {
+        p.errorAt(tok, "expected %s, found %s", what, describeToken(tok))
+        return &LiteralExpr{Pos: posOf(tok), Value: ""}
+    }
+    return p.parseExpression()
+}
+
+// parseAction parses the single statement after `->`. Statements that
+// open a block are not allowed there.
+func (p *Parser) parseAction() Node {
+    tok := p.peek()
+    if isLineEnd(tok) {
+        p.errorAt(tok, "expected an action after \"->\"")
+        p.skipLine()
+        return nil
+    }
+    if tok.Type == "KEYWORD" && blockKeywords[tok.Value] {
+        p.errorAt(tok, "%q cannot be used as an inline action", tok.Value)
+        p.skipLine()
+        return nil
+    }
+    return withPos(p.parseStatementKind(), tok)
+}
+
+// skipLine discards the remaining tokens of the current line.
+func (p *Parser) skipLine() {
+    for !isLineEnd(p.peek()) {
+        p.advance()
+    }
+    p.consume("NEWLINE")
+}
+
+func isLineEnd(t Token) bool {
+    return t.Type == "NEWLINE" || t.Type == "EOF"
+}
+
+func isKeyword(t Token, word string) bool {
+    return t.Type == "KEYWORD" && t.Value == word
+}
+
+func isOp(t Token, op string) bool {
+    return t.Type == "OP" && t.Value == op
+}
+
+func isPunct(t Token, punct string) bool {
+    return t.Type == "PUNCT" && t.Value == punct
+}
+
+func (p *Parser) check(typ string) bool {
+    return p.peek().Type == typ
+}
+
+func (p *Parser) checkKeyword(word string) bool {
+    return isKeyword(p.peek(), word)
+}
+
+func (p *Parser) matchKeyword(word string) bool {
+    if p.checkKeyword(word) {
+        p.advance()
+        return true
+    }
+    return false
+}
+
+func (p *Parser) matchOp(op string) bool {
+    if isOp(p.peek(), op) {
+        p.advance()
+        return true
+    }
+    return false
+}
+
+func (p *Parser) matchPunct(punct string) bool {
+    if isPunct(p.peek(), punct) {
+        p.advance()
+        return true
+    }
+    return false
+}
+
+func (p *Parser) expectKeyword(word string) bool {
+    if p.matchKeyword(word) {
+        return true
+    }
+    p.errorAt(p.peek(), "expected %q, found %s", word, describeToken(p.peek()))
+    return false
+}
+
+func (p *Parser) expectOp(op string) bool {
+    if p.matchOp(op) {
+        return true
+    }
+    p.errorAt(p.peek(), "expected %q, found %s", op, describeToken(p.peek()))
+    return false
+}
+
+func (p *Parser) expectPunct(punct string) bool {
+    if p.matchPunct(punct) {
+        return true
+    }
+    p.errorAt(p.peek(), "expected %q, found %s", punct, describeToken(p.peek()))
+    return false
+}
+
+func (p *Parser) expectIdent(what string) (Token, bool) {
+    tok := p.peek()
+    if tok.Type == "IDENT" {
+        return p.advance(), true
+    }
+    p.errorAt(tok, "expected %s, found %s", what, describeToken(tok))
+    return tok, false
+}
+
+// expectLineEnd consumes the end of a statement, reporting and skipping any
+// tokens left over on the line.
+func (p *Parser) expectLineEnd() {
+    if tok := p.peek(); !isLineEnd(tok) {
+        p.errorAt(tok, "unexpected %s", describeToken(tok))
+    }
+    p.skipLine()
 }
 
 func (p *Parser) peekAhead(offset int) Token {
@@ -0,0 +1,448 @@
+package lang
+
+import (
+    "strconv"
+    "unicode/utf8"
+)
+
+// Binding powers for infix operators, lowest first.
+const (
+    precOr = iota + 1
+    precAnd
+    precNot
+    precCompare
+    precAdd
+    precMul
+)
+
+var binaryPrec = map[string]int{
+    "or":  precOr,
+    "and": precAnd,
+    "==":  precCompare,
+    "!=":  precCompare,
+    "<":   precCompare,
+    "<=":  precCompare,
+    ">":   precCompare,
+    ">=":  precCompare,
+    "+":   precAdd,
+    "-":   precAdd,
+    "*":   precMul,
+    "/":   precMul,
+    "%":   precMul,
+}
+
+// parseExpression parses a full expression using precedence climbing.
+func (p *Parser) parseExpression() Expr {
+    return p.parseBinary(precOr)
+}
+
+func (p *Parser) parseBinary(minPrec int) Expr {
+    left := p.parseUnary()
+    for {
+        tok := p.peek()
+        prec, ok := infixPrec(tok)
+        if !ok || prec < minPrec {
+            return left
+        }
+        if p.inCommand && p.isSignedOperand() {
+            return left
+        }
+        p.advance()
+        right := p.parseBinary(prec + 1)
+        left = &BinaryExpr{Pos: posOf(tok), Op: tok.Value, Left: left, Right: right}
+    }
+}
+
+func (p *Parser) parseUnary() Expr {
+    tok := p.peek()
+    if p.matchKeyword("not") {
+        return &UnaryExpr{Pos: posOf(tok), Op: "not", Operand: p.parseBinary(precNot)}
+    }
+    if p.matchOp("-") {
+        return &UnaryExpr{Pos: posOf(tok), Op: "-", Operand: p.parseUnary()}
+    }
+    return p.parsePostfix()
+}
+
+func (p *Parser) parsePostfix() Expr {
+    expr := p.parsePrimary()
+    for {
+        switch {
+        case isPunct(p.peek(), "."):
+            p.advance()
+            at := posOf(p.peek())
+            expr = &MemberExpr{Pos: at, Object: expr, Name: p.expectMemberName()}
+        case isPunct(p.peek(), "(") && p.adjacent():
+            at := posOf(p.advance())
+            args, named := p.parseCallArgs()
+            expr = &CallExpr{Pos: at, Callee: expr, Args: args, Named: named}
+        case isPunct(p.peek(), "[") && p.adjacent():
+            expr = p.parseIndexOrSlice(expr, posOf(p.advance()))
+        default:
+            if isModuleMember(expr) && p.startsOperand() {
+                at := posOf(p.peek())
+                args, named := p.parseCommandArgs()
+                return &CallExpr{Pos: at, Callee: expr, Args: args, Named: named}
+            }
+            return expr
+        }
+    }
+}
+
+func (p *Parser) parsePrimary() Expr {
+    if tok := p.peek(); isLineEnd(tok) {
+        p.errorAt(tok, "expected an expression, found %s", describeToken(tok))
+        return &LiteralExpr{Pos: posOf(tok), Value: ""}
+    }
+    tok := p.advance()
+    at := posOf(tok)
+    switch tok.Type {
+    case "NUMBER":
+        if n, err := strconv.Atoi(tok.Value); err == nil {
+            return &LiteralExpr{Pos: at, Value: n}
+        }
+        f, _ := strconv.ParseFloat(tok.Value, 64)
+        return &LiteralExpr{Pos: at, Value: f}
+    case "STRING":
+        return &LiteralExpr{Pos: at, Value: tok.Value}
+    case "TEMPLATE":
+        return p.parseTemplate(tok)
+    case "IDENT":
+        return &IdentExpr{Pos: at, Name: tok.Value}
+    case "KEYWORD":
+        switch tok.Value {
+        case "true":
+            return &LiteralExpr{Pos: at, Value: true}
+        case "false":
+            return &LiteralExpr{Pos: at, Value: false}
+        case "null", "none":
+            return &LiteralExpr{Pos: at, Value: nil}
+        case "run":
+            return p.parseRunExpr()
+        case "task":
+            return p.parseLambda(tok)
+        }
+    case "PUNCT":
+        switch tok.Value {
+        case "(":
+            expr := p.parseNested()
+            p.expectPunct(")")
+            return expr
+        case "[":
+            return &ListExpr{Pos: at, Items: p.parseDelimited("]")}
+        case "{":
+            return p.parseDict(tok)
+        }
+    }
+    p.errorAt(tok, "expected an expression, found %s", describeToken(tok))
+    return &LiteralExpr{Pos: at, Value: ""}
+}
+
+// parseTemplate splits an interpolated string into literal text and the
+// expressions between braces. Each expression is lexed and parsed on its
+// own, with token positions shifted to where it sits in the source.
+func (p *Parser) parseTemplate(tok Token) Expr {
+    raw := []rune(tok.Value)
+    node := &InterpolatedExpr{Pos: posOf(tok)}
+    line, col := tok.Line, tok.Column
+    litStart := 0
+
+    for idx := 0; idx < len(raw); {
+        switch raw[idx] {
+        case '\\':
+            idx += 2
+            col += 2
+            continue
+        case '\n':
+            idx++
+            line, col = line+1, 1
+            continue
+        case '{':
+        default:
+            idx++
+            col++
+            continue
+        }
+
+        if idx > litStart {
+            node.Parts = append(node.Parts, &LiteralExpr{Value: unescape(raw[litStart:idx])})
+        }
+        end, _ := interpolationEnd(raw, idx, true)
+        node.Parts = append(node.Parts, p.parseInterpolation(raw[idx+1:end-1], line, col+1))
+        for _, r := range raw[idx:end] {
+            if r == '\n' {
+                line, col = line+1, 1
+            } else {
+                col++
+            }
+        }
+        idx, litStart = end, end
+    }
+    if litStart < len(raw) {
+        node.Parts = append(node.Parts, &LiteralExpr{Value: unescape(raw[litStart:])})
+    }
+    return node
+}
+
+// parseInterpolation parses the expression text of one `{...}`, which
+// starts at line and col in the source.
+func (p *Parser) parseInterpolation(src []rune, line, col int) Expr {
+    lead := 0
+    for lead < len(src) && (src[lead] == ' ' || src[lead] == '\t') {
+        lead++
+    }
+    tokens := NewLexer(string(src[lead:])).Tokenize()
+    for idx := range tokens {
+        if tokens[idx].Line == 1 {
+            tokens[idx].Column += col + lead - 1
+        }
+        tokens[idx].Line += line - 1
+    }
+
+    sub := &Parser{tokens: tokens, file: p.file, lines: p.lines, errorLines: p.errorLines}
+    var expr Expr
+    if first := sub.peek(); isLineEnd(first) {
+        sub.errorAt(Token{Line: line, Column: col}, "expected an expression inside \"{}\"")
+        expr = &LiteralExpr{Pos: Pos{Line: line, Column: col}, Value: ""}
+    } else {
+        expr = sub.parseExpression()
+        if tok := sub.peek(); !isLineEnd(tok) {
+            sub.errorAt(tok, "unexpected %s in interpolation", describeToken(tok))
+        }
+    }
+    p.diagnostics = append(p.diagnostics, sub.diagnostics...)
+    return expr
+}
+
+// parseIndexOrSlice parses what follows `[`, which is at: an index `x[i]`
+// or a slice `x[start:end]` where either bound may be left out.
+func (p *Parser) parseIndexOrSlice(object Expr, at Pos) Expr {
+    var start Expr
+    if !isPunct(p.peek(), ":") {
+        start = p.parseNested()
+    }
+    if !p.matchPunct(":") {
+        p.expectPunct("]")
+        return &IndexExpr{Pos: at, Object: object, Index: start}
+    }
+    var end Expr
+    if !isPunct(p.peek(), "]") {
+        end = p.parseNested()
+    }
+    p.expectPunct("]")
+    return &SliceExpr{Pos: at, Object: object, Start: start, End: end}
+}
+
+// parseDict parses a dict literal after its opening brace open. Keys are
+// names, strings or numbers and are always stored as strings.
+func (p *Parser) parseDict(open Token) Expr {
+    dict := &DictExpr{Pos: posOf(open)}
+    for !p.isAtEnd() && !isPunct(p.peek(), "}") {
+        keyTok := p.peek()
+        switch keyTok.Type {
+        case "IDENT", "KEYWORD", "STRING", "NUMBER":
+            p.advance()
+        default:
+            p.errorAt(keyTok, "expected a dict key, found %s", describeToken(keyTok))
+            return dict
+        }
+        p.expectPunct(":")
+        dict.Keys = append(dict.Keys, keyTok.Value)
+        dict.Values = append(dict.Values, p.parseNested())
+        if !p.matchPunct(",") {
+            break
+        }
+    }
+    p.expectPunct("}")
+    return dict
+}
+
+// expectMemberName reads the name after a `.`; keywords are allowed so that
+// functions like `dict.set` can be called.
+func (p *Parser) expectMemberName() string {
+    tok := p.peek()
+    if tok.Type == "IDENT" || tok.Type == "KEYWORD" {
+        p.advance()
+        return tok.Value
+    }
+    p.errorAt(tok, "expected a name after \".\", found %s", describeToken(tok))
+    return ""
+}
+
+// parseRunExpr parses `run task a, b` used as a value; it evaluates to
+// whatever the task returns.
+func (p *Parser) parseRunExpr() Expr {
+    nameTok, _ := p.expectIdent("a task name")
+    name := nameTok.Value
+    for p.matchPunct(".") {
+        part, _ := p.expectIdent("a task name")
+        name += "." + part.Value
+    }
+    args, named := p.parseCommandArgs()
+    return &CallExpr{Pos: posOf(nameTok), Callee: &IdentExpr{Pos: posOf(nameTok), Name: name}, Args: args, Named: named}
+}
+
+// parseLambda parses an anonymous task after its `task` keyword:
+// `task with a, b -> expr`, or `task -> expr` without parameters.
+func (p *Parser) parseLambda(head Token) Expr {
+    lambda := &LambdaExpr{Pos: posOf(head)}
+    if p.matchKeyword("with") {
+        lambda.Params = p.parseParams()
+    }
+    p.expectOp("->")
+    lambda.Body = p.parseNested()
+    return lambda
+}
+
+// parseNested parses an expression inside brackets, where command-style
+// arguments of an enclosing call do not apply.
+func (p *Parser) parseNested() Expr {
+    saved := p.inCommand
+    p.inCommand = false
+    expr := p.parseExpression()
+    p.inCommand = saved
+    return expr
+}
+
+// parseDelimited parses comma-separated expressions up to the closing punct.
+func (p *Parser) parseDelimited(closing string) []Expr {
+    var items []Expr
+    for !p.isAtEnd() && !isPunct(p.peek(), closing) {
+        items = append(items, p.parseNested())
+        if !p.matchPunct(",") {
+            break
+        }
+    }
+    p.expectPunct(closing)
+    return items
+}
+
+// parseCallArgs parses the arguments of `f(a, b, name: c)` after the
+// opening parenthesis.
+func (p *Parser) parseCallArgs() ([]Expr, []NamedArg) {
+    var args []Expr
+    var named []NamedArg
+    for !p.isAtEnd() && !isPunct(p.peek(), ")") {
+        if p.atNamedArg() {
+            named = p.parseNamedArg(named, p.parseNested)
+        } else {
+            args = append(args, p.parseNested())
+        }
+        if !p.matchPunct(",") {
+            break
+        }
+    }
+    p.expectPunct(")")
+    return args, named
+}
+
+// parseCommandArgs parses the arguments of a command-style call such as
+// `math.add 10 20` or `run greet "Ana", greeting: "Hi"`. Arguments are
+// separated by whitespace or commas and bind tighter than comparisons, so
+// `io.exists path and ready` reads as `(io.exists path) and ready`.
+func (p *Parser) parseCommandArgs() ([]Expr, []NamedArg) {
+    saved := p.inCommand
+    p.inCommand = true
+    var args []Expr
+    var named []NamedArg
+    for p.startsOperand() {
+        if p.atNamedArg() {
+            named = p.parseNamedArg(named, func() Expr { return p.parseBinary(precAdd) })
+        } else {
+            args = append(args, p.parseBinary(precAdd))
+        }
+        p.matchPunct(",")
+    }
+    p.inCommand = saved
+    return args, named
+}
+
+// atNamedArg reports whether the next tokens are `name:` followed by a
+// value, rather than a positional argument or the `:` ending a header.
+func (p *Parser) atNamedArg() bool {
+    return p.check("IDENT") && isPunct(p.peekAhead(1), ":") && !isLineEnd(p.peekAhead(2))
+}
+
+// parseNamedArg parses one `name: value` argument and appends it to named.
+func (p *Parser) parseNamedArg(named []NamedArg, value func() Expr) []NamedArg {
+    nameTok := p.advance()
+    p.advance() // consume :
+    for _, arg := range named {
+        if arg.Name == nameTok.Value {
+            p.errorAt(nameTok, "argument '%s' given more than once", nameTok.Value)
+        }
+    }
+    return append(named, NamedArg{Pos: posOf(nameTok), Name: nameTok.Value, Value: value()})
+}
+
+// startsOperand reports whether the next token can begin a command argument.
+func (p *Parser) startsOperand() bool {
+    tok := p.peek()
+    switch tok.Type {
+    case "STRING", "TEMPLATE", "NUMBER", "IDENT":
+        return true
+    case "KEYWORD":
+        switch tok.Value {
+        case "true", "false", "null", "none", "task":
+            return true
+        }
+        return false
+    case "PUNCT":
+        return tok.Value == "(" || tok.Value == "[" || tok.Value == "{"
+    case "OP":
+        return tok.Value == "-" && p.isSignedOperand()
+    }
+    return false
+}
+
+// isSignedOperand reports whether the next token is a `-` written as a sign,
+// as in `math.abs -42`: spaced from what precedes it but not from what follows.
+func (p *Parser) isSignedOperand() bool {
+    tok := p.peek()
+    if !isOp(tok, "-") {
+        return false
+    }
+    next := p.peekAhead(1)
+    return !p.adjacent() && next.Line == tok.Line && next.Column == tok.Column+1
+}
+
+// adjacent reports whether the next token directly follows the previous one
+// with no whitespace in between.
+func (p *Parser) adjacent() bool {
+    if p.pos == 0 {
+        return false
+    }
+    prev, tok := p.tokens[p.pos-1], p.peek()
+    return prev.Line == tok.Line && tokenEnd(prev) == tok.Column
+}
+
+// tokenEnd returns the column just past the token's source text.
+func tokenEnd(t Token) int {
+    width := utf8.RuneCountInString(t.Value)
+    if t.Type == "STRING" {
+        width += 2
+    }
+    return t.Column + width
+}
+
+// isModuleMember reports whether expr names a stdlib function like `math.add`.
+func isModuleMember(expr Expr) bool {
+    member, ok := expr.(*MemberExpr)
+    if !ok {
+        return false
+    }
+    ident, ok := member.Object.(*IdentExpr)
+    if !ok {
+        return false
+    }
+    _, ok = StdlibModules[ident.Name]
+    return ok
+}
+
+func infixPrec(t Token) (int, bool) {
+    if t.Type != "OP" && !(t.Type == "KEYWORD" && (t.Value == "and" || t.Value == "or")) {
+        return 0, false
+    }
+    prec, ok := binaryPrec[t.Value]
+    return prec, ok
+}
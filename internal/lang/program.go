@@ -0,0 +1,54 @@
+package lang
+
+// Program is a parsed and compiled program that can be run any number of
+// times, by any interpreter.
+type Program struct {
+    file  string
+    nodes []Node
+    code  *code
+}
+
+// Compile parses src and compiles it to bytecode. Syntax errors, including
+// those in expressions, are returned as diagnostics and no program is
+// built.
+func Compile(file, src string) (*Program, []Diagnostic) {
+    nodes, diags := ParseSource(file, src)
+    if len(diags) > 0 {
+        return nil, diags
+    }
+    return &Program{file: file, nodes: nodes, code: compileProgram(nodes)}, nil
+}
+
+// ProgramCache keeps compiled programs by their source text, so that
+// input seen before, such as a line repeated at the REPL, is neither parsed
+// nor compiled again. Once full, the oldest program is dropped.
+type ProgramCache struct {
+    max      int
+    programs map[string]*Program
+    order    []string
+}
+
+// NewProgramCache creates a cache holding up to max programs.
+func NewProgramCache(max int) *ProgramCache {
+    return &ProgramCache{max: max, programs: make(map[string]*Program)}
+}
+
+// Compile returns the cached program for src, compiling and caching it
+// if it is new. Source with syntax errors is not cached.
+func (c *ProgramCache) Compile(file, src string) (*Program, []Diagnostic) {
+    key := file + "\x00" + src
+    if prog, ok := c.programs[key]; ok {
+        return prog, nil
+    }
+    prog, diags := Compile(file, src)
+    if len(diags) > 0 {
+        return nil, diags
+    }
+    if len(c.order) >= c.max && c.max > 0 {
+        delete(c.programs, c.order[0])
+        c.order = c.order[1:]
+    }
+    c.programs[key] = prog
+    c.order = append(c.order, key)
+    return prog, nil
+}
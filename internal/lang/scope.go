@@ -0,0 +1,218 @@
+package lang
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+// DefaultMaxCallDepth bounds task recursion unless configured otherwise.
+const DefaultMaxCallDepth = 1000
+
+// scope is one link in the variable lookup chain. The global scope and each
+// task call get a frame scope; loop bodies and handlers get block scopes
+// nested inside their frame.
+type scope struct {
+    vars    map[string]Value
+    parent  *scope
+    frame   bool
+    globals map[string]bool
+}
+
+func newScope(parent *scope, frame bool) *scope {
+    s := &scope{vars: make(map[string]Value), parent: parent, frame: frame}
+    if frame {
+        s.globals = make(map[string]bool)
+    }
+    return s
+}
+
+// lookup finds name in this scope or any enclosing one.
+func (s *scope) lookup(name string) (Value, bool) {
+    for cur := s; cur != nil; cur = cur.parent {
+        if val, ok := cur.vars[name]; ok {
+            return val, true
+        }
+    }
+    return nil, false
+}
+
+// frameScope returns the task frame (or global scope) enclosing s.
+func (s *scope) frameScope() *scope {
+    cur := s
+    for !cur.frame {
+        cur = cur.parent
+    }
+    return cur
+}
+
+// flatten returns every variable visible from s, inner scopes winning.
+func (s *scope) flatten() map[string]Value {
+    out := make(map[string]Value)
+    for cur := s; cur != nil; cur = cur.parent {
+        for k, v := range cur.vars {
+            if _, seen := out[k]; !seen {
+                out[k] = v
+            }
+        }
+    }
+    return out
+}
+
+// copyVars returns a copy of a variable map.
+func copyVars(vars map[string]Value) map[string]Value {
+    out := make(map[string]Value, len(vars))
+    for k, v := range vars {
+        out[k] = v
+    }
+    return out
+}
+
+// isolateVars returns a deep copy of a variable map: lists and dicts are
+// copied too, so that a parallel task can change them without touching
+// the ones other tasks see. Containers that appear more than once, or
+// inside themselves, are copied once and stay shared within the copy.
+func isolateVars(vars map[string]Value) map[string]Value {
+    c := &valueCopier{lists: make(map[listKey][]Value), dicts: make(map[uintptr]map[string]Value)}
+    out := make(map[string]Value, len(vars))
+    for k, v := range vars {
+        out[k] = c.copy(v)
+    }
+    return out
+}
+
+// listKey identifies a list by its backing array and length.
+type listKey struct {
+    data   uintptr
+    length int
+}
+
+// valueCopier deep-copies values, remembering the containers it has
+// already copied.
+type valueCopier struct {
+    lists map[listKey][]Value
+    dicts map[uintptr]map[string]Value
+}
+
+func (c *valueCopier) copy(v Value) Value {
+    switch val := v.(type) {
+    case []Value:
+        if len(val) == 0 {
+            return make([]Value, 0, cap(val))
+        }
+        key := listKey{reflect.ValueOf(val).Pointer(), len(val)}
+        if done, ok := c.lists[key]; ok {
+            return done
+        }
+        list := make([]Value, len(val))
+        c.lists[key] = list
+        for idx, item := range val {
+            list[idx] = c.copy(item)
+        }
+        return list
+    case map[string]Value:
+        key := reflect.ValueOf(val).Pointer()
+        if done, ok := c.dicts[key]; ok {
+            return done
+        }
+        dict := make(map[string]Value, len(val))
+        c.dicts[key] = dict
+        for k, item := range val {
+            dict[k] = c.copy(item)
+        }
+        return dict
+    }
+    return v
+}
+
+// StackFrame records an active task call and the line it was called from,
+// which is zero for a call made by the host.
+type StackFrame struct {
+    Task string
+    Line int
+}
+
+// formatStack renders the call stack innermost call first.
+func formatStack(stack []StackFrame) string {
+    if len(stack) == 0 {
+        return ""
+    }
+    var sb strings.Builder
+    sb.WriteString("Call stack (most recent call first):")
+    repeats := 0
+    for idx := len(stack) - 1; idx >= 0; idx-- {
+        if idx < len(stack)-1 && stack[idx] == stack[idx+1] {
+            repeats++
+            continue
+        }
+        if repeats > 0 {
+            fmt.Fprintf(&sb, "\n  [previous call repeated %d more times]", repeats)
+            repeats = 0
+        }
+        if stack[idx].Line == 0 {
+            fmt.Fprintf(&sb, "\n  in task %s, called by the host", stack[idx].Task)
+        } else {
+            fmt.Fprintf(&sb, "\n  in task %s, called from line %d", stack[idx].Task, stack[idx].Line)
+        }
+    }
+    if repeats > 0 {
+        fmt.Fprintf(&sb, "\n  [previous call repeated %d more times]", repeats)
+    }
+    return sb.String()
+}
+
+// lookupVar reads a variable through the scope chain.
+func (i *Interpreter) lookupVar(name string) (Value, bool) {
+    return i.current.lookup(name)
+}
+
+// assignVar implements `set`. Names declared `global` in the current task
+// write to the global scope; otherwise an existing variable in the current
+// frame is updated, and a new one is created in the frame itself so that it
+// outlives the block it was set in.
+func (i *Interpreter) assignVar(name string, val Value) {
+    frame := i.current.frameScope()
+    if frame.globals[name] {
+        i.globals.vars[name] = val
+        return
+    }
+    for cur := i.current; cur != nil; cur = cur.parent {
+        if _, ok := cur.vars[name]; ok {
+            cur.vars[name] = val
+            return
+        }
+        if cur == frame {
+            break
+        }
+    }
+    frame.vars[name] = val
+}
+
+// assignElement implements `set d.key = v` and `set xs[0] = v`. The dict
+// or list is changed in place, so every variable referring to it sees the
+// new value.
+func (i *Interpreter) assignElement(target Expr, val Value) {
+    var err error
+    switch t := target.(type) {
+    case *MemberExpr:
+        err = setIndex(i.evaluateExpression(t.Object), t.Name, val)
+    case *IndexExpr:
+        err = setIndex(i.evaluateExpression(t.Object), i.evaluateExpression(t.Index), val)
+    }
+    if err != nil {
+        i.raise(errorKind(err), "%v", err)
+    }
+}
+
+// executeScoped runs a block in a fresh block scope. Variables passed in
+// bind is defined in that scope, e.g. a loop variable.
+func (i *Interpreter) executeScoped(body []Node, bind map[string]Value) flow {
+    saved := i.current
+    i.current = newScope(saved, false)
+    for name, val := range bind {
+        i.current.vars[name] = val
+    }
+    f := i.executeBlock(body)
+    i.current = saved
+    return f
+}
@@ -0,0 +1,112 @@
+package lang
+
+import (
+    "strings"
+)
+
+// signature is the static type of a builtin used by the checker.
+type signature struct {
+    params   []typeSet
+    required int
+    variadic bool
+    named    map[string]typeSet
+    result   typeSet
+}
+
+// builtinSignatures describes every builtin as `params -> result`. A
+// parameter written `type?` may be left out, `...type` takes any number
+// of arguments and `name: type` is an optional argument passed by name.
+var builtinSignatures = map[string]string{
+    "type_of": "any -> string",
+
+    "io.read":       "string -> string",
+    "io.write":      "string, any -> null",
+    "io.append":     "string, any -> null",
+    "io.print":      "...any -> null",
+    "io.warn":       "...any -> null",
+    "io.read_line":  "any? -> string",
+    "io.exists":     "string -> bool",
+    "io.read_lines": "string -> list",
+    "io.size":       "string -> int",
+    "io.dirname":    "string -> string",
+    "io.basename":   "string -> string",
+
+    "text.length":      "string -> int",
+    "text.upper":       "string -> string",
+    "text.lower":       "string -> string",
+    "text.trim":        "string, string? -> string",
+    "text.split":       "string, string -> list",
+    "text.contains":    "string, string -> bool",
+    "text.starts_with": "string, string -> bool",
+    "text.ends_with":   "string, string -> bool",
+
+    "math.add":  "...number -> number",
+    "math.sub":  "number, number, ...number -> number",
+    "math.mul":  "...number -> number",
+    "math.div":  "number, number, ...number -> number",
+    "math.sqrt": "number -> float",
+    "math.abs":  "number -> number",
+
+    "list.length":   "list -> int",
+    "list.append":   "list, any -> list",
+    "list.at":       "list, int -> any",
+    "list.contains": "list, any -> bool",
+    "list.map":      "list, task -> list",
+    "list.filter":   "list, task -> list",
+    "list.reduce":   "list, task, any? -> any",
+    "list.sort_by":  "list, task -> list",
+    "list.find":     "list, task -> any",
+
+    "dict.get":    "dict, string -> any",
+    "dict.set":    "dict, string, any -> dict",
+    "dict.keys":   "dict -> list",
+    "dict.values": "dict -> list",
+
+    "time.now":       " -> string",
+    "time.timestamp": " -> int",
+    "time.sleep":     "number -> null",
+    "time.format":    "number, string -> string",
+
+    "json.parse":     "string -> any",
+    "json.stringify": "any, indent: int -> string",
+
+    "path.join":   "string, ...string -> string",
+    "path.dir":    "string -> string",
+    "path.base":   "string -> string",
+    "path.ext":    "string -> string",
+    "path.exists": "string -> bool",
+}
+
+var signatures = parseSignatures(builtinSignatures)
+
+func parseSignatures(specs map[string]string) map[string]signature {
+    out := make(map[string]signature, len(specs))
+    for name, spec := range specs {
+        params, result, _ := strings.Cut(spec, "->")
+        sig := signature{result: typeNames[strings.TrimSpace(result)]}
+        for _, param := range strings.Split(params, ",") {
+            param = strings.TrimSpace(param)
+            switch {
+            case param == "":
+                continue
+            case strings.Contains(param, ":"):
+                key, typ, _ := strings.Cut(param, ":")
+                if sig.named == nil {
+                    sig.named = make(map[string]typeSet)
+                }
+                sig.named[strings.TrimSpace(key)] = typeNames[strings.TrimSpace(typ)]
+                continue
+            case strings.HasPrefix(param, "..."):
+                sig.variadic = true
+                param = param[3:]
+            case strings.HasSuffix(param, "?"):
+                param = strings.TrimSuffix(param, "?")
+            default:
+                sig.required++
+            }
+            sig.params = append(sig.params, typeNames[param])
+        }
+        out[name] = sig
+    }
+    return out
+}
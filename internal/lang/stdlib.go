@@ -1,37 +1,90 @@
 package lang
 
 import (
+    "context"
     "encoding/json"
-    "errors"
     "fmt"
+    "io"
     "math"
     "os"
     "path/filepath"
-    "strconv"
+    "sort"
     "strings"
     "time"
 )
 
-// BuiltinFunc represents a standard library function.
-type BuiltinFunc func(args []any) (any, error)
+// BuiltinFunc represents a standard library function. It receives the
+// context of the call along with its positional arguments.
+type BuiltinFunc func(c *CallContext, args []Value) (Value, error)
 
-// StdlibModules holds the core modules bundled in the binary.
-var StdlibModules = map[string]map[string]BuiltinFunc{
-    "io":   ioModule(),
-    "text": textModule(),
-    "math": mathModule(),
-    "list": listModule(),
-    "dict": dictModule(),
-    "time": timeModule(),
-    "json": jsonModule(),
-    "path": pathModule(),
+// CallContext describes one call of a builtin: the interpreter running it,
+// the context that cancels the program, the streams the program writes to
+// and reads from, where in the source the call is and any arguments passed
+// by name. Stdin is buffered and shared by every call, so that input one
+// call has read ahead is not lost to the next.
+type CallContext struct {
+    Interp *Interpreter
+    Ctx    context.Context
+    Stdout io.Writer
+    Stderr io.Writer
+    Stdin  LineReader
+    Name   string
+    File   string
+    Line   int
+    Named  map[string]Value
+}
+
+// A LineReader reads input up to a delimiter, as *bufio.Reader does.
+type LineReader interface {
+    ReadString(delim byte) (string, error)
+}
+
+// Call calls a task value, such as the task passed to `list.map`. An error
+// raised by the task is returned rather than unwinding through the builtin.
+func (c *CallContext) Call(fn Value, args ...Value) (Value, error) {
+    return c.Interp.Call(fn, args...)
+}
+
+// Errorf returns an error of the given kind reported at the call site.
+func (c *CallContext) Errorf(kind, format string, args ...any) error {
+    err := c.Interp.newError(kind, c.Name+": "+fmt.Sprintf(format, args...))
+    err.File, err.Line = c.File, c.Line
+    return err
+}
+
+// GlobalBuiltins are the functions callable without a module prefix.
+var GlobalBuiltins = map[string]BuiltinFunc{
+    "type_of": func(c *CallContext, args []Value) (Value, error) {
+        if len(args) != 1 {
+            return nil, argError("type_of expects one value")
+        }
+        return typeName(args[0]), nil
+    },
+}
+
+// StdlibModules holds the core modules bundled in the binary. It is filled
+// in by init because builtins such as list.map call back into the
+// interpreter, which itself looks modules up here.
+var StdlibModules map[string]map[string]BuiltinFunc
+
+func init() {
+    StdlibModules = map[string]map[string]BuiltinFunc{
+        "io":   ioModule(),
+        "text": textModule(),
+        "math": mathModule(),
+        "list": listModule(),
+        "dict": dictModule(),
+        "time": timeModule(),
+        "json": jsonModule(),
+        "path": pathModule(),
+    }
 }
 
 func ioModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "read": func(args []any) (any, error) {
+        "read": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("io.read expects path")
+                return "", argError("io.read expects path")
             }
             path := toString(args[0])
             data, err := os.ReadFile(path)
@@ -40,17 +93,17 @@ func ioModule() map[string]BuiltinFunc {
             }
             return string(data), nil
         },
-        "write": func(args []any) (any, error) {
+        "write": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return nil, errors.New("io.write expects path and data")
+                return nil, argError("io.write expects path and data")
             }
             path := toString(args[0])
             data := toString(args[1])
             return nil, os.WriteFile(path, []byte(data), 0o644)
         },
-        "append": func(args []any) (any, error) {
+        "append": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return nil, errors.New("io.append expects path and data")
+                return nil, argError("io.append expects path and data")
             }
             path := toString(args[0])
             data := toString(args[1])
@@ -62,22 +115,45 @@ func ioModule() map[string]BuiltinFunc {
             _, err = f.WriteString(data)
             return nil, err
         },
-        "exists": func(args []any) (any, error) {
+        "print": func(c *CallContext, args []Value) (Value, error) {
+            _, err := io.WriteString(c.Stdout, joinValues(args))
+            return nil, err
+        },
+        "warn": func(c *CallContext, args []Value) (Value, error) {
+            _, err := io.WriteString(c.Stderr, joinValues(args)+"\n")
+            return nil, err
+        },
+        "read_line": func(c *CallContext, args []Value) (Value, error) {
+            if len(args) > 0 {
+                if _, err := io.WriteString(c.Stdout, toString(args[0])); err != nil {
+                    return nil, err
+                }
+            }
+            line, err := c.Stdin.ReadString('\n')
+            if err == io.EOF && line == "" {
+                return nil, nil
+            }
+            if err != nil && err != io.EOF {
+                return nil, err
+            }
+            return strings.TrimRight(line, "\r\n"), nil
+        },
+        "exists": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return false, errors.New("io.exists expects path")
+                return false, argError("io.exists expects path")
             }
             path := toString(args[0])
             _, err := os.Stat(path)
             return err == nil, nil
         },
-        "read_lines": func(args []any) (any, error) {
+        "read_lines": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return []string{}, errors.New("io.read_lines expects path")
+                return nil, argError("io.read_lines expects path")
             }
             path := toString(args[0])
             data, err := os.ReadFile(path)
             if err != nil {
-                return []string{}, err
+                return nil, err
             }
             lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
             if len(lines) > 0 && lines[len(lines)-1] == "" {
@@ -85,54 +161,63 @@ func ioModule() map[string]BuiltinFunc {
             }
             return lines, nil
         },
-        "size": func(args []any) (any, error) {
+        "size": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return 0, errors.New("io.size expects path")
+                return 0, argError("io.size expects path")
             }
             info, err := os.Stat(toString(args[0]))
             if err != nil {
                 return 0, err
             }
-            return info.Size(), nil
+            return int(info.Size()), nil
         },
-        "dirname": func(args []any) (any, error) {
+        "dirname": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("io.dirname expects path")
+                return "", argError("io.dirname expects path")
             }
             return filepath.Dir(toString(args[0])), nil
         },
-        "basename": func(args []any) (any, error) {
+        "basename": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("io.basename expects path")
+                return "", argError("io.basename expects path")
             }
             return filepath.Base(toString(args[0])), nil
         },
     }
 }
 
+// joinValues renders values as text separated by spaces.
+func joinValues(args []Value) string {
+    parts := make([]string, len(args))
+    for idx, arg := range args {
+        parts[idx] = toString(arg)
+    }
+    return strings.Join(parts, " ")
+}
+
 func textModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "length": func(args []any) (any, error) {
+        "length": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return 0, errors.New("text.length expects string")
+                return 0, argError("text.length expects string")
             }
             return len([]rune(toString(args[0]))), nil
         },
-        "upper": func(args []any) (any, error) {
+        "upper": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("text.upper expects string")
+                return "", argError("text.upper expects string")
             }
             return strings.ToUpper(toString(args[0])), nil
         },
-        "lower": func(args []any) (any, error) {
+        "lower": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("text.lower expects string")
+                return "", argError("text.lower expects string")
             }
             return strings.ToLower(toString(args[0])), nil
         },
-        "trim": func(args []any) (any, error) {
+        "trim": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("text.trim expects string")
+                return "", argError("text.trim expects string")
             }
             cutset := " "
             if len(args) > 1 {
@@ -140,27 +225,27 @@ func textModule() map[string]BuiltinFunc {
             }
             return strings.Trim(toString(args[0]), cutset), nil
         },
-        "split": func(args []any) (any, error) {
+        "split": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return []string{}, errors.New("text.split expects string and delimiter")
+                return nil, argError("text.split expects string and delimiter")
             }
             return strings.Split(toString(args[0]), toString(args[1])), nil
         },
-        "contains": func(args []any) (any, error) {
+        "contains": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return false, errors.New("text.contains expects haystack and needle")
+                return false, argError("text.contains expects haystack and needle")
             }
             return strings.Contains(toString(args[0]), toString(args[1])), nil
         },
-        "starts_with": func(args []any) (any, error) {
+        "starts_with": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return false, errors.New("text.starts_with expects haystack and prefix")
+                return false, argError("text.starts_with expects haystack and prefix")
             }
             return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
         },
-        "ends_with": func(args []any) (any, error) {
+        "ends_with": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return false, errors.New("text.ends_with expects haystack and suffix")
+                return false, argError("text.ends_with expects haystack and suffix")
             }
             return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
         },
@@ -169,183 +254,290 @@ func textModule() map[string]BuiltinFunc {
 
 func mathModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "add": func(args []any) (any, error) { return numericFold(args, 0, func(a, b float64) float64 { return a + b }) },
-        "sub": func(args []any) (any, error) {
+        "add": func(c *CallContext, args []Value) (Value, error) { return numericFold("math.add", "+", args, 0) },
+        "sub": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return 0, errors.New("math.sub expects at least 2 numbers")
-            }
-            start := toFloat(args[0])
-            for _, v := range args[1:] {
-                start -= toFloat(v)
+                return 0, argError("math.sub expects at least 2 numbers")
             }
-            return start, nil
+            return numericFold("math.sub", "-", args[1:], args[0])
         },
-        "mul": func(args []any) (any, error) { return numericFold(args, 1, func(a, b float64) float64 { return a * b }) },
-        "div": func(args []any) (any, error) {
+        "mul": func(c *CallContext, args []Value) (Value, error) { return numericFold("math.mul", "*", args, 1) },
+        "div": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return 0, errors.New("math.div expects at least 2 numbers")
+                return 0, argError("math.div expects at least 2 numbers")
             }
-            start := toFloat(args[0])
-            for _, v := range args[1:] {
-                denom := toFloat(v)
-                if denom == 0 {
-                    return 0, errors.New("division by zero")
-                }
-                start /= denom
-            }
-            return start, nil
+            return numericFold("math.div", "/", args[1:], args[0])
         },
-        "sqrt": func(args []any) (any, error) {
+        "sqrt": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return 0, errors.New("math.sqrt expects number")
+                return 0, argError("math.sqrt expects number")
             }
-            return math.Sqrt(toFloat(args[0])), nil
+            n, err := numberArg("math.sqrt", args[0])
+            if err != nil {
+                return nil, err
+            }
+            f, _ := asNumber(n)
+            return math.Sqrt(f), nil
         },
-        "abs": func(args []any) (any, error) {
+        "abs": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return 0, errors.New("math.abs expects number")
+                return 0, argError("math.abs expects number")
             }
-            return math.Abs(toFloat(args[0])), nil
+            n, err := numberArg("math.abs", args[0])
+            if err != nil {
+                return nil, err
+            }
+            if i, ok := asInt(n); ok && i < 0 {
+                return -i, nil
+            }
+            if f, ok := n.(float64); ok {
+                return math.Abs(f), nil
+            }
+            return n, nil
         },
     }
 }
 
-func numericFold(args []any, seed float64, op func(a, b float64) float64) (any, error) {
-    if len(args) == 0 {
-        return seed, nil
+// numericFold applies an arithmetic operator across args, starting from
+// seed, with the same int and float rules as the operator itself.
+func numericFold(name, op string, args []Value, seed Value) (Value, error) {
+    total, err := numberArg(name, seed)
+    if err != nil {
+        return nil, err
     }
-    total := seed
     for _, v := range args {
-        total = op(total, toFloat(v))
+        n, err := numberArg(name, v)
+        if err != nil {
+            return nil, err
+        }
+        if total, err = arithmetic(op, total, n); err != nil {
+            return nil, err
+        }
     }
     return total, nil
 }
 
+// numberArg reads a numeric builtin argument; numeric strings are accepted.
+func numberArg(name string, v Value) (Value, error) {
+    n, ok := toNumber(v)
+    if !ok {
+        return nil, typeError("%s expects numbers, got %s", name, typeName(v))
+    }
+    return n, nil
+}
+
 // LIST MODULE
 func listModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "length": func(args []any) (any, error) {
+        "length": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return 0, errors.New("list.length expects list")
+                return 0, argError("list.length expects list")
             }
-            switch v := args[0].(type) {
-            case []any:
-                return len(v), nil
-            case []string:
-                return len(v), nil
-            default:
-                return 0, fmt.Errorf("list.length: got %T, expected list", args[0])
+            lst, ok := args[0].([]Value)
+            if !ok {
+                return 0, argError("list.length: got %s, expected list", typeName(args[0]))
             }
+            return len(lst), nil
         },
-        "append": func(args []any) (any, error) {
+        "append": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return nil, errors.New("list.append expects list and item")
+                return nil, argError("list.append expects list and item")
             }
-            lst, ok := args[0].([]any)
+            lst, ok := args[0].([]Value)
             if !ok {
-                return nil, errors.New("list.append: first arg must be list")
+                return nil, argError("list.append: first arg must be list")
             }
             return append(lst, args[1]), nil
         },
-        "at": func(args []any) (any, error) {
+        "at": func(c *CallContext, args []Value) (Value, error) {
+            if len(args) < 2 {
+                return nil, argError("list.at expects list and index")
+            }
+            if _, ok := args[0].([]Value); !ok {
+                return nil, argError("list.at: got %s, expected list", typeName(args[0]))
+            }
+            return indexOf(args[0], args[1])
+        },
+        "contains": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return nil, errors.New("list.at expects list and index")
+                return false, argError("list.contains expects list and item")
+            }
+            lst, _ := args[0].([]Value)
+            for _, x := range lst {
+                if valuesEqual(x, args[1]) {
+                    return true, nil
+                }
+            }
+            return false, nil
+        },
+        "map": func(c *CallContext, args []Value) (Value, error) {
+            lst, fn, err := listAndTask("list.map", args)
+            if err != nil {
+                return nil, err
+            }
+            out := make([]Value, 0, len(lst))
+            for _, item := range lst {
+                v, err := c.Call(fn, item)
+                if err != nil {
+                    return nil, err
+                }
+                out = append(out, v)
+            }
+            return out, nil
+        },
+        "filter": func(c *CallContext, args []Value) (Value, error) {
+            lst, fn, err := listAndTask("list.filter", args)
+            if err != nil {
+                return nil, err
             }
-            idx := int(toFloat(args[1]))
-            switch v := args[0].(type) {
-            case []any:
-                if idx < 0 || idx >= len(v) {
-                    return nil, errors.New("list.at: index out of bounds")
+            out := []Value{}
+            for _, item := range lst {
+                keep, err := c.Call(fn, item)
+                if err != nil {
+                    return nil, err
                 }
-                return v[idx], nil
-            case []string:
-                if idx < 0 || idx >= len(v) {
-                    return nil, errors.New("list.at: index out of bounds")
+                if isTruthy(keep) {
+                    out = append(out, item)
                 }
-                return v[idx], nil
-            default:
-                return nil, fmt.Errorf("list.at: got %T, expected list", args[0])
             }
+            return out, nil
         },
-        "contains": func(args []any) (any, error) {
-            if len(args) < 2 {
-                return false, errors.New("list.contains expects list and item")
-            }
-            item := args[1]
-            switch v := args[0].(type) {
-            case []any:
-                for _, x := range v {
-                    if fmt.Sprint(x) == fmt.Sprint(item) {
-                        return true, nil
-                    }
+        "reduce": func(c *CallContext, args []Value) (Value, error) {
+            lst, fn, err := listAndTask("list.reduce", args)
+            if err != nil {
+                return nil, err
+            }
+            var acc Value
+            if len(args) > 2 {
+                acc = args[2]
+            } else if len(lst) > 0 {
+                acc, lst = lst[0], lst[1:]
+            } else {
+                return nil, argError("list.reduce of an empty list needs an initial value")
+            }
+            for _, item := range lst {
+                if acc, err = c.Call(fn, acc, item); err != nil {
+                    return nil, err
                 }
-            case []string:
-                itemStr := toString(item)
-                for _, x := range v {
-                    if x == itemStr {
-                        return true, nil
-                    }
+            }
+            return acc, nil
+        },
+        "sort_by": func(c *CallContext, args []Value) (Value, error) {
+            lst, fn, err := listAndTask("list.sort_by", args)
+            if err != nil {
+                return nil, err
+            }
+            keys := make([]Value, len(lst))
+            for idx, item := range lst {
+                if keys[idx], err = c.Call(fn, item); err != nil {
+                    return nil, err
                 }
             }
-            return false, nil
+            order := make([]int, len(lst))
+            for idx := range order {
+                order[idx] = idx
+            }
+            var cmpErr error
+            sort.SliceStable(order, func(a, b int) bool {
+                cmp, err := compareValues(keys[order[a]], keys[order[b]])
+                if err != nil && cmpErr == nil {
+                    cmpErr = err
+                }
+                return cmp < 0
+            })
+            if cmpErr != nil {
+                return nil, cmpErr
+            }
+            out := make([]Value, len(lst))
+            for idx, src := range order {
+                out[idx] = lst[src]
+            }
+            return out, nil
         },
+        "find": func(c *CallContext, args []Value) (Value, error) {
+            lst, fn, err := listAndTask("list.find", args)
+            if err != nil {
+                return nil, err
+            }
+            for _, item := range lst {
+                found, err := c.Call(fn, item)
+                if err != nil {
+                    return nil, err
+                }
+                if isTruthy(found) {
+                    return item, nil
+                }
+            }
+            return nil, nil
+        },
+    }
+}
+
+// listAndTask reads the list and task arguments of the list functions that
+// take a task.
+func listAndTask(name string, args []Value) ([]Value, Value, error) {
+    if len(args) < 2 {
+        return nil, nil, argError("%s expects list and task", name)
+    }
+    lst, ok := args[0].([]Value)
+    if !ok {
+        return nil, nil, argError("%s: got %s, expected list", name, typeName(args[0]))
+    }
+    if _, ok := args[1].(*TaskRef); !ok {
+        return nil, nil, argError("%s: got %s, expected task", name, typeName(args[1]))
     }
+    return lst, args[1], nil
 }
 
 // DICT MODULE
 func dictModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "get": func(args []any) (any, error) {
+        "get": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return nil, errors.New("dict.get expects dict and key")
+                return nil, argError("dict.get expects dict and key")
             }
-            d, ok := args[0].(map[string]any)
+            d, ok := args[0].(map[string]Value)
             if !ok {
-                return nil, errors.New("dict.get: first arg must be dict")
+                return nil, argError("dict.get: first arg must be dict")
             }
-            key := toString(args[1])
-            if val, exists := d[key]; exists {
-                return val, nil
-            }
-            return nil, nil
+            return d[toString(args[1])], nil
         },
-        "set": func(args []any) (any, error) {
+        "set": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 3 {
-                return nil, errors.New("dict.set expects dict, key, and value")
+                return nil, argError("dict.set expects dict, key, and value")
             }
-            d, ok := args[0].(map[string]any)
+            d, ok := args[0].(map[string]Value)
             if !ok {
-                d = make(map[string]any)
+                d = make(map[string]Value)
             }
-            key := toString(args[1])
-            d[key] = args[2]
+            d[toString(args[1])] = args[2]
             return d, nil
         },
-        "keys": func(args []any) (any, error) {
+        "keys": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return []string{}, errors.New("dict.keys expects dict")
+                return nil, argError("dict.keys expects dict")
             }
-            d, ok := args[0].(map[string]any)
+            d, ok := args[0].(map[string]Value)
             if !ok {
-                return []string{}, errors.New("dict.keys: arg must be dict")
+                return nil, argError("dict.keys: arg must be dict")
             }
-            var keys []string
-            for k := range d {
+            keys := make([]Value, 0, len(d))
+            for _, k := range sortedKeys(d) {
                 keys = append(keys, k)
             }
             return keys, nil
         },
-        "values": func(args []any) (any, error) {
+        "values": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return []any{}, errors.New("dict.values expects dict")
+                return nil, argError("dict.values expects dict")
             }
-            d, ok := args[0].(map[string]any)
+            d, ok := args[0].(map[string]Value)
             if !ok {
-                return []any{}, errors.New("dict.values: arg must be dict")
+                return nil, argError("dict.values: arg must be dict")
             }
-            var vals []any
-            for _, v := range d {
-                vals = append(vals, v)
+            vals := make([]Value, 0, len(d))
+            for _, k := range sortedKeys(d) {
+                vals = append(vals, d[k])
             }
             return vals, nil
         },
@@ -355,27 +547,41 @@ func dictModule() map[string]BuiltinFunc {
 // TIME MODULE
 func timeModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "now": func(args []any) (any, error) {
+        "now": func(c *CallContext, args []Value) (Value, error) {
             return time.Now().Format(time.RFC3339), nil
         },
-        "timestamp": func(args []any) (any, error) {
-            return time.Now().Unix(), nil
+        "timestamp": func(c *CallContext, args []Value) (Value, error) {
+            return int(time.Now().Unix()), nil
         },
-        "sleep": func(args []any) (any, error) {
+        "sleep": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return nil, errors.New("time.sleep expects milliseconds")
+                return nil, argError("time.sleep expects milliseconds")
+            }
+            n, err := numberArg("time.sleep", args[0])
+            if err != nil {
+                return nil, err
+            }
+            ms, _ := asNumber(n)
+            timer := time.NewTimer(time.Duration(ms * float64(time.Millisecond)))
+            defer timer.Stop()
+            select {
+            case <-timer.C:
+                return nil, nil
+            case <-c.Ctx.Done():
+                return nil, c.Ctx.Err()
             }
-            ms := int(toFloat(args[0]))
-            time.Sleep(time.Duration(ms) * time.Millisecond)
-            return nil, nil
         },
-        "format": func(args []any) (any, error) {
+        "format": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 2 {
-                return "", errors.New("time.format expects timestamp and layout")
+                return "", argError("time.format expects timestamp and layout")
+            }
+            n, err := numberArg("time.format", args[0])
+            if err != nil {
+                return nil, err
             }
-            ts := int64(toFloat(args[0]))
+            ts, _ := asNumber(n)
             layout := toString(args[1])
-            t := time.Unix(ts, 0)
+            t := time.Unix(int64(ts), 0)
             return t.Format(layout), nil
         },
     }
@@ -384,20 +590,32 @@ func timeModule() map[string]BuiltinFunc {
 // JSON MODULE
 func jsonModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "parse": func(args []any) (any, error) {
+        "parse": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return nil, errors.New("json.parse expects string")
+                return nil, argError("json.parse expects string")
             }
-            jsonStr := toString(args[0])
+            dec := json.NewDecoder(strings.NewReader(toString(args[0])))
+            dec.UseNumber()
             var result any
-            if err := json.Unmarshal([]byte(jsonStr), &result); err != nil {
+            if err := dec.Decode(&result); err != nil {
                 return nil, err
             }
-            return result, nil
+            return normalize(result), nil
         },
-        "stringify": func(args []any) (any, error) {
+        "stringify": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("json.stringify expects value")
+                return "", argError("json.stringify expects value")
+            }
+            if indent, ok := c.Named["indent"]; ok {
+                n, isInt := indent.(int)
+                if !isInt || n < 0 {
+                    return "", c.Errorf(KindArgument, "indent must be a whole number of spaces, got %s", typeName(indent))
+                }
+                data, err := json.MarshalIndent(args[0], "", strings.Repeat(" ", n))
+                if err != nil {
+                    return "", err
+                }
+                return string(data), nil
             }
             data, err := json.Marshal(args[0])
             if err != nil {
@@ -411,9 +629,9 @@ func jsonModule() map[string]BuiltinFunc {
 // PATH MODULE
 func pathModule() map[string]BuiltinFunc {
     return map[string]BuiltinFunc{
-        "join": func(args []any) (any, error) {
+        "join": func(c *CallContext, args []Value) (Value, error) {
             if len(args) == 0 {
-                return "", errors.New("path.join expects at least one path")
+                return "", argError("path.join expects at least one path")
             }
             parts := make([]string, 0, len(args))
             for _, arg := range args {
@@ -421,59 +639,30 @@ func pathModule() map[string]BuiltinFunc {
             }
             return filepath.Join(parts...), nil
         },
-        "dir": func(args []any) (any, error) {
+        "dir": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("path.dir expects path")
+                return "", argError("path.dir expects path")
             }
             return filepath.Dir(toString(args[0])), nil
         },
-        "base": func(args []any) (any, error) {
+        "base": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("path.base expects path")
+                return "", argError("path.base expects path")
             }
             return filepath.Base(toString(args[0])), nil
         },
-        "ext": func(args []any) (any, error) {
+        "ext": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return "", errors.New("path.ext expects path")
+                return "", argError("path.ext expects path")
             }
             return filepath.Ext(toString(args[0])), nil
         },
-        "exists": func(args []any) (any, error) {
+        "exists": func(c *CallContext, args []Value) (Value, error) {
             if len(args) < 1 {
-                return false, errors.New("path.exists expects path")
+                return false, argError("path.exists expects path")
             }
             _, err := os.Stat(toString(args[0]))
             return err == nil, nil
         },
     }
 }
-
-func toString(v any) string {
-    switch val := v.(type) {
-    case string:
-        return val
-    case []byte:
-        return string(val)
-    default:
-        return strings.TrimSpace(strings.Trim(fmt.Sprint(val), "\n"))
-    }
-}
-
-func toFloat(v any) float64 {
-    switch val := v.(type) {
-    case int:
-        return float64(val)
-    case int64:
-        return float64(val)
-    case float64:
-        return val
-    case float32:
-        return float64(val)
-    case string:
-        f, _ := strconv.ParseFloat(strings.TrimSpace(val), 64)
-        return f
-    default:
-        return 0
-    }
-}
@@ -0,0 +1,79 @@
+package lang
+
+import (
+    "strings"
+)
+
+// typeSet is a static type: the set of value kinds an expression may
+// evaluate to. The checker works with sets so that a value it cannot pin
+// down, such as a task argument without an annotation, is simply every
+// kind and never reported.
+type typeSet uint16
+
+const (
+    noType     typeSet = 0
+    nullType   typeSet = 1 << NullValue
+    boolType   typeSet = 1 << BoolValue
+    intType    typeSet = 1 << IntValue
+    floatType  typeSet = 1 << FloatValue
+    stringType typeSet = 1 << StringValue
+    listType   typeSet = 1 << ListValue
+    dictType   typeSet = 1 << DictValue
+    taskType   typeSet = 1 << TaskValue
+    errorType  typeSet = 1 << ErrorValue
+    numberType         = intType | floatType
+    anyType            = nullType | boolType | numberType | stringType | listType | dictType | taskType | errorType
+)
+
+// typeNames are the names a type annotation may use.
+var typeNames = map[string]typeSet{
+    "any":    anyType,
+    "null":   nullType,
+    "bool":   boolType,
+    "int":    intType,
+    "float":  floatType,
+    "number": numberType,
+    "string": stringType,
+    "list":   listType,
+    "dict":   dictType,
+    "task":   taskType,
+    "error":  errorType,
+}
+
+// typeOfKind returns the type holding just kind k.
+func typeOfKind(k ValueKind) typeSet {
+    return 1 << k
+}
+
+// has reports whether t includes kind k.
+func (t typeSet) has(k ValueKind) bool {
+    return t&typeOfKind(k) != 0
+}
+
+// fits reports whether a value of type t may be used where want is
+// expected, that is whether any kind is in both.
+func (t typeSet) fits(want typeSet) bool {
+    return t&want != 0
+}
+
+// String names a type the way annotations write it, listing the kinds of a
+// union: "number", "string or null".
+func (t typeSet) String() string {
+    switch t {
+    case anyType:
+        return "any"
+    case noType:
+        return "nothing"
+    }
+    var names []string
+    if t&numberType == numberType {
+        names = append(names, "number")
+        t &^= numberType
+    }
+    for k := NullValue; k <= ErrorValue; k++ {
+        if t.has(k) {
+            names = append(names, k.String())
+        }
+    }
+    return strings.Join(names, " or ")
+}
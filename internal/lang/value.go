@@ -0,0 +1,408 @@
+package lang
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Value is an Athera runtime value. Every value is one of the Go types
+// below, chosen by its kind; anything coming from outside the interpreter
+// (builtin results, decoded JSON, values from the host) is passed through
+// normalize first. Value is a type of its own rather than any, so that a
+// host's []any or map[string]any is not taken for a list or dict without
+// being converted, and hostValue converts values back for the host.
+//
+//    null    nil
+//    bool    bool
+//    int     int
+//    float   float64
+//    string  string
+//    list    []Value
+//    dict    map[string]Value
+//    task    *TaskRef
+//    error   *RuntimeError
+type Value interface{}
+
+// ValueKind identifies which kind of value a Value holds.
+type ValueKind int
+
+const (
+    NullValue ValueKind = iota
+    BoolValue
+    IntValue
+    FloatValue
+    StringValue
+    ListValue
+    DictValue
+    TaskValue
+    ErrorValue
+)
+
+var valueKindNames = [...]string{"null", "bool", "int", "float", "string", "list", "dict", "task", "error"}
+
+// String returns the name scripts see from type_of.
+func (k ValueKind) String() string {
+    return valueKindNames[k]
+}
+
+// TaskRef is a task used as a value: either a named task, looked up in
+// namespace ns when it is called, or an anonymous task together with the
+// scope it was created in, or for compiled code, the variables it
+// captured.
+type TaskRef struct {
+    Name    string
+    ns      *namespace
+    lambda  *TaskDef
+    closure *scope
+    upvals  []*cell
+}
+
+// kindOf reports the kind of a normalized value.
+func kindOf(v Value) ValueKind {
+    switch v.(type) {
+    case nil:
+        return NullValue
+    case bool:
+        return BoolValue
+    case int:
+        return IntValue
+    case float64:
+        return FloatValue
+    case string:
+        return StringValue
+    case []Value:
+        return ListValue
+    case map[string]Value:
+        return DictValue
+    case *TaskRef:
+        return TaskValue
+    case *RuntimeError:
+        return ErrorValue
+    }
+    panic(fmt.Sprintf("lang: value of Go type %T was not normalized", v))
+}
+
+// typeName describes a value's kind for error messages.
+func typeName(v Value) string {
+    return kindOf(v).String()
+}
+
+// normalize converts a Go value into its Value representation: sized
+// integers become int, slices become lists, string-keyed maps become
+// dicts, and so on recursively. Types with no Athera equivalent become
+// their printed form.
+func normalize(v any) Value {
+    switch val := v.(type) {
+    case nil, bool, int, float64, string, *TaskRef, *RuntimeError:
+        return val
+    case int64:
+        return int(val)
+    case int32:
+        return int(val)
+    case float32:
+        return float64(val)
+    case json.Number:
+        if n, err := strconv.Atoi(val.String()); err == nil {
+            return n
+        }
+        f, _ := val.Float64()
+        return f
+    case []byte:
+        return string(val)
+    case []string:
+        list := make([]Value, len(val))
+        for idx, s := range val {
+            list[idx] = s
+        }
+        return list
+    case []Value:
+        list := make([]Value, len(val))
+        for idx, item := range val {
+            list[idx] = normalize(item)
+        }
+        return list
+    case map[string]string:
+        dict := make(map[string]Value, len(val))
+        for k, s := range val {
+            dict[k] = s
+        }
+        return dict
+    case map[string]Value:
+        dict := make(map[string]Value, len(val))
+        for k, item := range val {
+            dict[k] = normalize(item)
+        }
+        return dict
+    case []any:
+        list := make([]Value, len(val))
+        for idx, item := range val {
+            list[idx] = normalize(item)
+        }
+        return list
+    case map[string]any:
+        dict := make(map[string]Value, len(val))
+        for k, item := range val {
+            dict[k] = normalize(item)
+        }
+        return dict
+    }
+    return normalizeReflect(v)
+}
+
+// hostValue converts a value for Go code outside the interpreter: lists
+// become []any and dicts map[string]any, recursively, and other values are
+// returned as they are.
+func hostValue(v Value) any {
+    switch val := v.(type) {
+    case []Value:
+        list := make([]any, len(val))
+        for idx, item := range val {
+            list[idx] = hostValue(item)
+        }
+        return list
+    case map[string]Value:
+        dict := make(map[string]any, len(val))
+        for k, item := range val {
+            dict[k] = hostValue(item)
+        }
+        return dict
+    }
+    return v
+}
+
+// normalizeReflect converts the values normalize has no case for, such as
+// a host's []int or map[string]float64, by their kind.
+func normalizeReflect(v any) Value {
+    rv := reflect.ValueOf(v)
+    switch rv.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return int(rv.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return int(rv.Uint())
+    case reflect.Float32, reflect.Float64:
+        return rv.Float()
+    case reflect.Bool:
+        return rv.Bool()
+    case reflect.String:
+        return rv.String()
+    case reflect.Slice, reflect.Array:
+        list := make([]Value, rv.Len())
+        for idx := range list {
+            list[idx] = normalize(rv.Index(idx).Interface())
+        }
+        return list
+    case reflect.Map:
+        if rv.Type().Key().Kind() != reflect.String {
+            break
+        }
+        dict := make(map[string]Value, rv.Len())
+        iter := rv.MapRange()
+        for iter.Next() {
+            dict[iter.Key().String()] = normalize(iter.Value().Interface())
+        }
+        return dict
+    }
+    return fmt.Sprint(v)
+}
+
+// isTruthy reports whether a value counts as true in a condition: null,
+// false, zero and empty strings, lists and dicts are false.
+func isTruthy(v Value) bool {
+    switch val := v.(type) {
+    case nil:
+        return false
+    case bool:
+        return val
+    case int:
+        return val != 0
+    case float64:
+        return val != 0
+    case string:
+        return val != ""
+    case []Value:
+        return len(val) > 0
+    case map[string]Value:
+        return len(val) > 0
+    }
+    return true
+}
+
+// asInt returns v as an int when it holds an integer value.
+func asInt(v Value) (int, bool) {
+    n, ok := v.(int)
+    return n, ok
+}
+
+// asNumber returns v as a float64 when it holds any numeric value.
+func asNumber(v Value) (float64, bool) {
+    switch val := v.(type) {
+    case int:
+        return float64(val), true
+    case float64:
+        return val, true
+    }
+    return 0, false
+}
+
+// toNumber converts v to a number the way builtins read numeric arguments:
+// numbers as they are and strings holding a number are parsed.
+func toNumber(v Value) (Value, bool) {
+    switch val := v.(type) {
+    case int, float64:
+        return val, true
+    case string:
+        s := strings.TrimSpace(val)
+        if n, err := strconv.Atoi(s); err == nil {
+            return n, true
+        }
+        if f, err := strconv.ParseFloat(s, 64); err == nil {
+            return f, true
+        }
+    }
+    return nil, false
+}
+
+// toString renders a value as text, as `greet` and string concatenation
+// show it. Strings nested in lists and dicts are quoted.
+func toString(v Value) string {
+    if s, ok := v.(string); ok {
+        return s
+    }
+    var sb strings.Builder
+    writeValue(&sb, v)
+    return sb.String()
+}
+
+func writeValue(sb *strings.Builder, v Value) {
+    switch val := v.(type) {
+    case nil:
+        sb.WriteString("null")
+    case bool:
+        sb.WriteString(strconv.FormatBool(val))
+    case int:
+        sb.WriteString(strconv.Itoa(val))
+    case float64:
+        // Whole floats keep a ".0" so they read differently from ints.
+        text := strconv.FormatFloat(val, 'g', -1, 64)
+        if !strings.ContainsAny(text, ".eIN") {
+            text += ".0"
+        }
+        sb.WriteString(text)
+    case string:
+        sb.WriteString(strconv.Quote(val))
+    case []Value:
+        sb.WriteByte('[')
+        for idx, item := range val {
+            if idx > 0 {
+                sb.WriteString(", ")
+            }
+            writeValue(sb, item)
+        }
+        sb.WriteByte(']')
+    case map[string]Value:
+        sb.WriteByte('{')
+        for idx, key := range sortedKeys(val) {
+            if idx > 0 {
+                sb.WriteString(", ")
+            }
+            sb.WriteString(strconv.Quote(key))
+            sb.WriteString(": ")
+            writeValue(sb, val[key])
+        }
+        sb.WriteByte('}')
+    case *TaskRef:
+        fmt.Fprintf(sb, "<task %s>", val.Name)
+    case *RuntimeError:
+        fmt.Fprintf(sb, "%s: %s", val.Kind, val.Message)
+    }
+}
+
+// sortedKeys returns the keys of a dict in order, so that dicts print and
+// iterate the same way every run.
+func sortedKeys(d map[string]Value) []string {
+    keys := make([]string, 0, len(d))
+    for k := range d {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// valuesEqual compares numbers by value, lists and dicts by content, and
+// everything else by kind and identity. Values of different kinds are
+// never equal, except int and float.
+func valuesEqual(left, right Value) bool {
+    if lf, ok := asNumber(left); ok {
+        rf, ok := asNumber(right)
+        return ok && lf == rf
+    }
+    switch l := left.(type) {
+    case []Value:
+        r, ok := right.([]Value)
+        if !ok || len(l) != len(r) {
+            return false
+        }
+        for idx := range l {
+            if !valuesEqual(l[idx], r[idx]) {
+                return false
+            }
+        }
+        return true
+    case map[string]Value:
+        r, ok := right.(map[string]Value)
+        if !ok || len(l) != len(r) {
+            return false
+        }
+        for k, lv := range l {
+            rv, ok := r[k]
+            if !ok || !valuesEqual(lv, rv) {
+                return false
+            }
+        }
+        return true
+    case *TaskRef:
+        r, ok := right.(*TaskRef)
+        return ok && l.Name == r.Name && l.lambda == r.lambda
+    }
+    return left == right
+}
+
+// compareValues orders two values: numbers by value, strings by their
+// bytes, and lists element by element. Other kinds cannot be ordered.
+func compareValues(left, right Value) (int, error) {
+    if lf, ok := asNumber(left); ok {
+        if rf, ok := asNumber(right); ok {
+            return compareOrdered(lf, rf), nil
+        }
+    }
+    switch l := left.(type) {
+    case string:
+        if r, ok := right.(string); ok {
+            return compareOrdered(l, r), nil
+        }
+    case []Value:
+        if r, ok := right.([]Value); ok {
+            for idx := 0; idx < len(l) && idx < len(r); idx++ {
+                if cmp, err := compareValues(l[idx], r[idx]); err != nil || cmp != 0 {
+                    return cmp, err
+                }
+            }
+            return compareOrdered(float64(len(l)), float64(len(r))), nil
+        }
+    }
+    return 0, typeError("cannot compare %s and %s", typeName(left), typeName(right))
+}
+
+func compareOrdered[T float64 | string](a, b T) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,554 @@
+package lang
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// frame is a running call of compiled code.
+type frame struct {
+    code   *code
+    locals []Value
+    upvals []*cell
+    ret    Value
+}
+
+// unsetSlot marks a slot whose variable has not been set yet. Reading one
+// falls back to the global of the same name, as the tree walker's scope
+// chain does.
+type unsetSlot struct{}
+
+var unset Value = unsetSlot{}
+
+// status tells the caller of exec how a region of code finished.
+type status int
+
+const (
+    statusDone status = iota
+    statusReturn
+    statusJump
+)
+
+func newFrame(cd *code, upvals []*cell) *frame {
+    f := &frame{code: cd, locals: make([]Value, len(cd.slotNames)), upvals: upvals}
+    for slot := range f.locals {
+        if cd.cells[slot] {
+            f.locals[slot] = &cell{v: unset}
+        } else {
+            f.locals[slot] = unset
+        }
+    }
+    return f
+}
+
+// store sets a slot, through its box if it has one.
+func (f *frame) store(slot int, v Value) {
+    if f.code.cells[slot] {
+        f.locals[slot].(*cell).v = v
+        return
+    }
+    f.locals[slot] = v
+}
+
+// runCode runs a compiled program.
+func (i *Interpreter) runCode(cd *code) {
+    i.exec(newFrame(cd, nil), 0, len(cd.instrs))
+}
+
+// runBody runs a task body without binding arguments, as `run parallel`
+// does.
+func (i *Interpreter) runBody(td TaskDef) {
+    if td.code == nil {
+        i.executeBlock(td.Body)
+        return
+    }
+    i.exec(newFrame(td.code, nil), td.code.bodyStart, len(td.code.instrs))
+}
+
+// invokeCode is invoke for compiled tasks: it binds the arguments into the
+// parameter slots of a new frame and runs the body.
+func (i *Interpreter) invokeCode(name string, def *TaskDef, upvals []*cell, args []Value, named map[string]Value, line int) Value {
+    i.checkContext()
+    if len(i.callStack) >= i.maxCallDepth {
+        i.raise(KindRecursion, "maximum call depth of %d exceeded calling task '%s'", i.maxCallDepth, name)
+    }
+
+    savedNS := i.switchNamespace(def.ns)
+    cd := def.code
+    f := newFrame(cd, upvals)
+    savedLine := i.line
+    i.line = line
+    i.bindArgs(name, def.Params, args, named, func(idx int, v Value) {
+        f.store(cd.paramSlots[idx], v)
+    }, func(idx int) Value {
+        i.exec(f, cd.defaults[idx].start, cd.defaults[idx].end)
+        return i.pop()
+    })
+    i.callStack = append(i.callStack, StackFrame{Task: name, Line: line})
+
+    i.exec(f, cd.bodyStart, len(cd.instrs))
+
+    i.callStack = i.callStack[:len(i.callStack)-1]
+    i.line = savedLine
+    i.switchNamespace(savedNS)
+    return f.ret
+}
+
+func (i *Interpreter) push(v Value) {
+    i.stack = append(i.stack, v)
+}
+
+func (i *Interpreter) pop() Value {
+    top := len(i.stack) - 1
+    v := i.stack[top]
+    i.stack = i.stack[:top]
+    return v
+}
+
+// popN removes the top n values and returns them in push order.
+func (i *Interpreter) popN(n int) []Value {
+    top := len(i.stack) - n
+    values := make([]Value, n)
+    copy(values, i.stack[top:])
+    i.stack = i.stack[:top]
+    return values
+}
+
+// popArgs removes the arguments of a call described by site.
+func (i *Interpreter) popArgs(argc int, site *callSite) ([]Value, map[string]Value) {
+    var named map[string]Value
+    if len(site.named) > 0 {
+        values := i.popN(len(site.named))
+        named = make(map[string]Value, len(values))
+        for idx, name := range site.named {
+            named[name] = values[idx]
+        }
+    }
+    return i.popN(argc), named
+}
+
+// exec runs the instructions of f from pc up to end. It stops early on
+// `return`, or on a jump outside [pc, end], such as `break` inside a
+// protect block, handing the target to the enclosing region.
+func (i *Interpreter) exec(f *frame, pc, end int) (status, int) {
+    start := pc
+    instrs, consts := f.code.instrs, f.code.consts
+    for pc < end {
+        in := instrs[pc]
+        pc++
+        switch in.op {
+        case opConst:
+            i.push(consts[in.a])
+        case opPop:
+            i.stack = i.stack[:len(i.stack)-1]
+        case opLine:
+            i.line = in.a
+        case opLoadLocal:
+            v := f.locals[in.a]
+            if v == unset {
+                v = i.loadGlobal(f, pc-1, f.code.slotNames[in.a])
+            }
+            i.push(v)
+        case opLoadCell:
+            v := f.locals[in.a].(*cell).v
+            if v == unset {
+                v = i.loadGlobal(f, pc-1, f.code.slotNames[in.a])
+            }
+            i.push(v)
+        case opLoadUpval:
+            v := f.upvals[in.a].v
+            if v == unset {
+                v = i.loadGlobal(f, pc-1, f.code.upvalNames[in.a])
+            }
+            i.push(v)
+        case opLoadGlobal:
+            i.push(i.loadGlobal(f, pc-1, consts[in.a].(string)))
+        case opStoreLocal:
+            f.locals[in.a] = i.pop()
+        case opStoreCell:
+            f.locals[in.a].(*cell).v = i.pop()
+        case opStoreGlobal:
+            i.globals.vars[consts[in.a].(string)] = i.pop()
+        case opBindCell:
+            f.locals[in.a] = &cell{v: i.pop()}
+        case opList:
+            i.push(i.popN(in.a))
+        case opDict:
+            keys := consts[in.a].([]string)
+            top := len(i.stack) - len(keys)
+            dict := make(map[string]Value, len(keys))
+            for idx, key := range keys {
+                dict[key] = i.stack[top+idx]
+            }
+            i.stack = append(i.stack[:top], dict)
+        case opInterp:
+            top := len(i.stack) - in.a
+            var sb strings.Builder
+            for _, part := range i.stack[top:] {
+                sb.WriteString(toString(part))
+            }
+            i.stack = append(i.stack[:top], sb.String())
+        case opNeg:
+            res, err := negate(i.pop())
+            i.check(err)
+            i.push(res)
+        case opNot:
+            i.push(!isTruthy(i.pop()))
+        case opTruthy:
+            i.push(isTruthy(i.pop()))
+        case opBinary:
+            right := i.pop()
+            left := i.pop()
+            i.push(i.binary(in.a, left, right))
+        case opMember:
+            res, err := memberOf(i.pop(), consts[in.a].(string))
+            i.check(err)
+            i.push(res)
+        case opModuleMember:
+            site := consts[in.a].(*callSite)
+            if shadow, shadowed := i.lookupRef(f, site.ref); shadowed {
+                res, err := memberOf(shadow, site.name)
+                i.check(err)
+                i.push(res)
+            } else {
+                i.push(i.callBuiltin(site.module+"."+site.name, site.fn, nil, nil))
+            }
+        case opIndex:
+            idx := i.pop()
+            res, err := indexOf(i.pop(), idx)
+            i.check(err)
+            i.push(res)
+        case opSlice:
+            obj := i.pop()
+            var from, to Value
+            if in.a&2 != 0 {
+                to = i.pop()
+            }
+            if in.a&1 != 0 {
+                from = i.pop()
+            }
+            res, err := sliceOf(obj, from, to)
+            i.check(err)
+            i.push(res)
+        case opSetMember:
+            obj := i.pop()
+            i.check(setIndex(obj, consts[in.a].(string), i.pop()))
+        case opSetIndex:
+            idx := i.pop()
+            obj := i.pop()
+            i.check(setIndex(obj, idx, i.pop()))
+        case opPathExists:
+            _, err := os.Stat(toString(i.pop()))
+            i.push(err == nil)
+        case opJump:
+            if pc = in.a; pc < start || pc > end {
+                return statusJump, pc
+            }
+        case opJumpFalse:
+            if !isTruthy(i.pop()) {
+                if pc = in.a; pc < start || pc > end {
+                    return statusJump, pc
+                }
+            }
+        case opJumpTrue:
+            if isTruthy(i.pop()) {
+                if pc = in.a; pc < start || pc > end {
+                    return statusJump, pc
+                }
+            }
+        case opRepeatCount:
+            i.push(i.repeatCount(i.pop()))
+        case opForN:
+            done := f.locals[in.a].(int)
+            if done >= f.locals[in.a+1].(int) {
+                if pc = in.b; pc > end {
+                    return statusJump, pc
+                }
+                continue
+            }
+            i.checkIterations(done, in.c)
+            i.checkContext()
+            f.locals[in.a] = done + 1
+        case opIterate:
+            done := f.locals[in.a].(int)
+            i.checkIterations(done, in.b)
+            i.checkContext()
+            f.locals[in.a] = done + 1
+        case opEachInit:
+            if items := i.stack[len(i.stack)-1]; kindOf(items) != ListValue {
+                i.raise(KindType, "repeat each expects a list, got %s", typeName(items))
+            }
+        case opForEach:
+            items, next := f.locals[in.a].([]Value), f.locals[in.a+1].(int)
+            if next >= len(items) {
+                if pc = in.b; pc > end {
+                    return statusJump, pc
+                }
+                continue
+            }
+            i.checkContext()
+            f.locals[in.a+1] = next + 1
+            i.push(items[next])
+        case opCallName:
+            site := consts[in.b].(*callSite)
+            args, named := i.popArgs(in.a, site)
+            i.push(i.callName(f, site, args, named))
+        case opCallModule:
+            site := consts[in.b].(*callSite)
+            args, named := i.popArgs(in.a, site)
+            if shadow, shadowed := i.lookupRef(f, site.ref); shadowed {
+                i.push(i.callMember(shadow, site.module, site.name, args, named, site.line))
+                continue
+            }
+            if site.fn == nil {
+                i.raise(KindRuntime, "unknown function %s", site.name)
+            }
+            i.push(i.callBuiltin(site.module+"."+site.name, site.fn, args, named))
+        case opCallMember:
+            site := consts[in.b].(*callSite)
+            object := i.pop()
+            args, named := i.popArgs(in.a, site)
+            i.push(i.callMember(object, site.module, site.name, args, named, site.line))
+        case opCallValue:
+            site := consts[in.b].(*callSite)
+            callee := i.pop()
+            args, named := i.popArgs(in.a, site)
+            i.push(i.callValue(callee, args, named, site.line))
+        case opClosure:
+            lambda := consts[in.a].(*code)
+            upvals := make([]*cell, len(lambda.captures))
+            for idx, cp := range lambda.captures {
+                if cp.fromUpval {
+                    upvals[idx] = f.upvals[cp.index]
+                } else {
+                    upvals[idx] = f.locals[cp.index].(*cell)
+                }
+            }
+            def := &TaskDef{Params: lambda.params, code: lambda, ns: i.ns}
+            i.push(&TaskRef{Name: "lambda", lambda: def, upvals: upvals})
+        case opDefineTask:
+            proto := consts[in.a].(*taskProto)
+            i.tasks[proto.name] = TaskDef{Body: proto.body, Params: proto.params, code: proto.code, ns: i.ns, exported: proto.exported}
+        case opReturn:
+            f.ret = i.pop()
+            return statusReturn, pc
+        case opGreet:
+            fmt.Fprintln(i.stdout, toString(i.pop()))
+        case opBackup:
+            dst := toString(i.pop())
+            i.backup(toString(i.pop()), dst)
+        case opUse:
+            i.executeUse(consts[in.a].(*UseNode))
+        case opRaise:
+            kind := consts[in.a].(string)
+            if kind == "" {
+                kind = KindUser
+            }
+            msg := kind
+            if in.b == 1 {
+                msg = toString(i.pop())
+            }
+            i.raise(kind, "%s", msg)
+        case opParallel:
+            site := consts[in.a].(*parallelSite)
+            vars := copyVars(i.globals.vars)
+            for _, ref := range site.refs {
+                if v, ok := i.lookupSlot(f, ref); ok {
+                    vars[ref.name] = v
+                }
+            }
+            i.runParallel(site.node, vars)
+        case opProtect:
+            site := consts[in.a].(*protectSite)
+            st, target := i.execProtect(f, site)
+            switch st {
+            case statusReturn:
+                return st, target
+            case statusJump:
+                if pc = target; pc < start || pc > end {
+                    return statusJump, pc
+                }
+            default:
+                pc = site.end
+            }
+        }
+    }
+    return statusDone, pc
+}
+
+// execProtect runs the body of a protect block. A runtime error raised in
+// it unwinds the value stack and call stack to where the block started,
+// then runs the first handler matching its kind.
+func (i *Interpreter) execProtect(f *frame, site *protectSite) (st status, target int) {
+    savedSP, savedDepth, savedNS := len(i.stack), len(i.callStack), i.ns
+
+    defer func() {
+        r := recover()
+        if r == nil {
+            return
+        }
+        rtErr := i.asRuntimeError(r)
+        i.switchNamespace(savedNS)
+        i.stack, i.callStack = i.stack[:savedSP], i.callStack[:savedDepth]
+        for _, h := range site.handlers {
+            if kindMatches(rtErr.Kind, h.kind) {
+                if f.code.cells[h.slot] {
+                    f.locals[h.slot] = &cell{v: rtErr}
+                } else {
+                    f.locals[h.slot] = rtErr
+                }
+                st, target = i.exec(f, h.start, h.end)
+                return
+            }
+        }
+        panic(rtErr)
+    }()
+
+    return i.exec(f, site.body.start, site.body.end)
+}
+
+// binary applies binaryOperators[op], with a shortcut for two ints.
+func (i *Interpreter) binary(op int, left, right Value) Value {
+    if l, ok := left.(int); ok {
+        if r, ok := right.(int); ok {
+            switch op {
+            case binAdd:
+                return l + r
+            case binSub:
+                return l - r
+            case binMul:
+                return l * r
+            case binMod:
+                if r != 0 {
+                    return l % r
+                }
+            case binEq:
+                return l == r
+            case binNe:
+                return l != r
+            case binLt:
+                return float64(l) < float64(r)
+            case binLe:
+                return float64(l) <= float64(r)
+            case binGt:
+                return float64(l) > float64(r)
+            case binGe:
+                return float64(l) >= float64(r)
+            }
+        }
+    }
+    res, err := binaryOp(binaryOperators[op], left, right)
+    i.check(err)
+    return res
+}
+
+// check raises err, if any, as a runtime error of its kind.
+func (i *Interpreter) check(err error) {
+    if err != nil {
+        i.raise(errorKind(err), "%v", err)
+    }
+}
+
+// repeatCount converts the count of `repeat N times` to an int.
+func (i *Interpreter) repeatCount(v Value) int {
+    count, ok := asInt(v)
+    if !ok {
+        if f, isNum := asNumber(v); isNum && f == float64(int(f)) {
+            count, ok = int(f), true
+        }
+    }
+    if !ok {
+        i.raise(KindType, "repeat count must be a whole number, got %s", typeName(v))
+    }
+    return count
+}
+
+// callName calls a name the way the tree walker does: a variable holding
+// a task, then unless it is a `run` statement a global builtin that no task
+// overrides, then a task.
+func (i *Interpreter) callName(f *frame, site *callSite, args []Value, named map[string]Value) Value {
+    if fn, ok := i.lookupRef(f, site.ref); ok {
+        return i.callValue(fn, args, named, site.line)
+    }
+    if !site.noBuiltin {
+        if _, isTask := i.tasks[site.name]; !isTask {
+            if fn, ok := GlobalBuiltins[site.name]; ok {
+                return i.callBuiltin(site.name, fn, args, named)
+            }
+        }
+    }
+    return i.callTask(site.name, args, named, site.line)
+}
+
+// lookupSlot reads a slot or captured variable if it has been set.
+func (i *Interpreter) lookupSlot(f *frame, ref varRef) (Value, bool) {
+    var v Value
+    switch ref.kind {
+    case varLocal:
+        v = f.locals[ref.index]
+    case varCell:
+        v = f.locals[ref.index].(*cell).v
+    case varUpval:
+        v = f.upvals[ref.index].v
+    default:
+        return nil, false
+    }
+    return v, v != unset
+}
+
+// lookupRef is lookupVar for compiled code: the variable ref resolved to,
+// or the global of that name.
+func (i *Interpreter) lookupRef(f *frame, ref varRef) (Value, bool) {
+    if v, ok := i.lookupSlot(f, ref); ok {
+        return v, true
+    }
+    v, ok := i.globals.vars[ref.name]
+    return v, ok
+}
+
+// loadGlobal reads a name that is not set in the frame: a global, a task
+// used as a value, or in lenient mode the name itself. pc is the
+// instruction reading it.
+func (i *Interpreter) loadGlobal(f *frame, pc int, name string) Value {
+    if v, ok := i.globals.vars[name]; ok {
+        return v
+    }
+    if _, ok := i.tasks[name]; ok {
+        return &TaskRef{Name: name, ns: i.ns}
+    }
+    if i.lenient {
+        return name
+    }
+    i.raiseUndefined(name, i.visibleVars(f, pc))
+    return nil
+}
+
+// visibleVars collects the globals and the variables set in f that are in
+// scope at pc, for the hint of an undefined variable error. The slots of
+// blocks that have ended keep their last values, so they are skipped.
+func (i *Interpreter) visibleVars(f *frame, pc int) map[string]Value {
+    vars := copyVars(i.globals.vars)
+    for slot, name := range f.code.slotNames {
+        if block, ok := f.code.blockSpans[slot]; ok && (pc < block.start || pc >= block.end) {
+            continue
+        }
+        if v, ok := i.lookupSlot(f, f.code.slotRef(name, slot)); ok && name != "" {
+            vars[name] = v
+        }
+    }
+    for idx, name := range f.code.upvalNames {
+        if v := f.upvals[idx].v; v != unset {
+            vars[name] = v
+        }
+    }
+    return vars
+}
+
+// slotRef refers to slot, through its box if it has one.
+func (cd *code) slotRef(name string, slot int) varRef {
+    if cd.cells[slot] {
+        return varRef{kind: varCell, index: slot, name: name}
+    }
+    return varRef{kind: varLocal, index: slot, name: name}
+}
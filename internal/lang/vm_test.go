@@ -0,0 +1,181 @@
+package lang
+
+import (
+    "bytes"
+    "errors"
+    "strings"
+    "testing"
+)
+
+// engineCases are programs that must behave the same on the bytecode VM
+// and on the tree walker. want is the output both must print and, for a
+// program that fails, wantErr the start of the error both must return.
+var engineCases = []struct {
+    name    string
+    src     string
+    want    string
+    wantErr string
+}{
+    {
+        name: "closures",
+        src: `task make_adder with n:
+    return task with x -> x + n
+set add2 = make_adder(2)
+greet add2(5)
+set adders = []
+repeat each n in [1, 2, 3]:
+    set adders = list.append(adders, task with x -> x + n)
+repeat each f in adders:
+    greet f(10)
+set scale = 3
+set scaled = task with x, by = scale -> x * by
+greet scaled(2)
+set scale = 4
+greet scaled(2)
+greet list.map([1, 2], task with x -> x * 2)`,
+        want: "7\n11\n12\n13\n6\n8\n[2, 4]\n",
+    },
+    {
+        name: "protect with loop control",
+        src: `task first_big with xs:
+    repeat each x in xs:
+        protect:
+            check x > 2 -> return x
+            check x == 1 -> continue
+            raise "small " + x
+        handle UserError:
+            greet "handled " + error
+    return null
+greet first_big([0, 1, 3, 4])
+repeat 5 times:
+    protect:
+        set n = 1
+        break
+    handle:
+        greet "never"
+greet "after break"
+set i = 0
+repeat while i < 4:
+    set i = i + 1
+    protect:
+        check i == 2 -> continue
+        greet "pass " + i
+    handle:
+        greet error`,
+        want: "handled UserError: small 0\n3\nafter break\npass 1\npass 3\npass 4\n",
+    },
+    {
+        name: "parameter defaults",
+        src: `task greet_person with name, greeting = "Hi", mark = greeting + "!":
+    return greeting + ", " + name + mark
+greet greet_person("Ana")
+greet greet_person("Bo", "Hello")
+greet greet_person("Cy", mark: "?")
+run greet_person name: "Di", greeting: "Hey"
+task total with label, ...nums:
+    return label + ": " + list.reduce(nums, task with a, b -> a + b, 0)
+greet total("sum", 1, 2, 3)
+greet total("none")`,
+        want: "Hi, AnaHi!\nHello, BoHello!\nHi, Cy?\nsum: 6\nnone: 0\n",
+    },
+    {
+        name: "shadowing",
+        src: `set x = "global"
+task show:
+    greet x
+task local:
+    set x = "local"
+    greet x
+run show
+run local
+greet x
+repeat each x in [1, 2]:
+    greet x
+greet x
+set text = {upper: task with s -> "mine"}
+greet text.upper("a")`,
+        want: "global\nlocal\nglobal\n1\n2\nglobal\nmine\n",
+    },
+    {
+        name:    "undefined variable",
+        src:     "set count = 1\n\ngreet cuont",
+        wantErr: "<source>:3: UndefinedVariable: undefined variable 'cuont' (did you mean 'count'?)",
+    },
+    {
+        name:    "block variable out of scope",
+        src:     "repeat each item in [1]:\n    greet item\ngreet item",
+        want:    "1\n",
+        wantErr: "<source>:3: UndefinedVariable: undefined variable 'item'",
+    },
+    {
+        name:    "type error in task",
+        src:     "task bad with n:\n    return n + [1]\n\nrun bad 1",
+        wantErr: "<source>:2: TypeError:",
+    },
+    {
+        name:    "division by zero in closure",
+        src:     "set f = task with x -> x / 0\ngreet f(1)",
+        wantErr: "<source>:1: DivisionByZero: division by zero\nCall stack (most recent call first):\n  in task lambda, called from line 2",
+    },
+    {
+        name:    "missing argument",
+        src:     "task pair with a, b:\n    return a\ngreet pair(1)",
+        wantErr: "<source>:3: ArgumentError:",
+    },
+    {
+        name:    "unknown task",
+        src:     "greet \"start\"\nrun nowhere",
+        want:    "start\n",
+        wantErr: "<source>:2: TaskNotFound: task 'nowhere' not found",
+    },
+    {
+        name:    "unhandled kind escapes protect",
+        src:     "protect:\n    set x = 1 / 0\nhandle TypeError:\n    greet \"wrong\"",
+        wantErr: "<source>:2: DivisionByZero:",
+    },
+    {
+        name:    "recursion limit",
+        src:     "task down with n:\n    return down(n + 1)\nrun down 0",
+        wantErr: "<source>:2: RecursionError:",
+    },
+}
+
+// runEngine runs src on the tree walker or the VM and returns what it
+// printed and the error it returned, if any.
+func runEngine(t *testing.T, src string, treeWalker bool) (string, string) {
+    t.Helper()
+    var out bytes.Buffer
+    err := RunSource(src, Options{TreeWalker: treeWalker, Stdout: &out, Stderr: &out, Stdin: strings.NewReader("")})
+    var parseErr *ParseError
+    if errors.As(err, &parseErr) {
+        t.Fatalf("syntax error: %v", err)
+    }
+    if err != nil {
+        return out.String(), err.Error()
+    }
+    return out.String(), ""
+}
+
+func TestEnginesAgree(t *testing.T) {
+    for _, tc := range engineCases {
+        t.Run(tc.name, func(t *testing.T) {
+            treeOut, treeErr := runEngine(t, tc.src, true)
+            vmOut, vmErr := runEngine(t, tc.src, false)
+            if treeOut != vmOut {
+                t.Errorf("output differs:\ntree walker: %q\nVM:          %q", treeOut, vmOut)
+            }
+            if treeErr != vmErr {
+                t.Errorf("error differs:\ntree walker: %q\nVM:          %q", treeErr, vmErr)
+            }
+            if vmOut != tc.want {
+                t.Errorf("output = %q, want %q", vmOut, tc.want)
+            }
+            switch {
+            case tc.wantErr == "" && vmErr != "":
+                t.Errorf("unexpected error: %s", vmErr)
+            case !strings.HasPrefix(vmErr, tc.wantErr):
+                t.Errorf("error = %q, want it to start with %q", vmErr, tc.wantErr)
+            }
+        })
+    }
+}
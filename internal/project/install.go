@@ -0,0 +1,345 @@
+package project
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// Fetch copies the package that source names into the folder dest. A
+// source is a folder, a .tar.gz, .tgz or .zip
+// archive, or a git repository checkout, of which the files committed at
+// HEAD are taken, or at the revision after a `#`, as in `../repo#v1.2`.
+// Relative sources are relative to base. An archive holding a single
+// folder has that folder's contents installed.
+func Fetch(source, base, dest string) error {
+    src, ref, err := sourcePath(source)
+    if err != nil {
+        return err
+    }
+    if !filepath.IsAbs(src) {
+        src = filepath.Join(base, src)
+    }
+    info, err := os.Stat(src)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(dest, 0o755); err != nil {
+        return err
+    }
+
+    lower := strings.ToLower(src)
+    switch {
+    case info.IsDir() && isGitRepo(src):
+        return fetchGit(src, ref, dest)
+    case ref != "":
+        return fmt.Errorf("%s is not a git repository, so it has no revision %q", source, ref)
+    case info.IsDir():
+        return copyDir(src, dest)
+    case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+        err = extractTarGz(src, dest)
+    case strings.HasSuffix(lower, ".zip"):
+        err = extractZip(src, dest)
+    default:
+        return fmt.Errorf("%s is not a folder, a .tar.gz or .zip archive, or a git repository", source)
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %v", source, err)
+    }
+    return flattenSingleDir(dest)
+}
+
+// HashSource returns the hash that the package source would have once
+// installed; see HashDir.
+func HashSource(source, base string) (string, error) {
+    src, ref, err := sourcePath(source)
+    if err != nil {
+        return "", err
+    }
+    if !filepath.IsAbs(src) {
+        src = filepath.Join(base, src)
+    }
+    if info, err := os.Stat(src); err == nil && info.IsDir() && ref == "" && !isGitRepo(src) {
+        return HashDir(src)
+    }
+
+    tmp, err := os.MkdirTemp("", "athera-package-")
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tmp)
+    dest := filepath.Join(tmp, "package")
+    if err := Fetch(source, base, dest); err != nil {
+        return "", err
+    }
+    return HashDir(dest)
+}
+
+// Install fetches dep into root/<dep.Name>, replacing any earlier copy,
+// and records it in lock. A dependency without a name is named by
+// PackageName. If lock already holds the package, taken from the same
+// source, the files fetched must match the locked hash; a package that
+// does not is left uninstalled.
+func Install(root, base string, dep Dependency, lock *Lock) (LockedDependency, error) {
+    if err := os.MkdirAll(root, 0o755); err != nil {
+        return LockedDependency{}, err
+    }
+    // Fetch into a hidden folder beside the final one, so that a failed
+    // install leaves the installed copy as it was.
+    tmp, err := os.MkdirTemp(root, ".install-")
+    if err != nil {
+        return LockedDependency{}, err
+    }
+    defer os.RemoveAll(tmp)
+    staged := filepath.Join(tmp, "package")
+    if err := Fetch(dep.Source, base, staged); err != nil {
+        return LockedDependency{}, fmt.Errorf("install %s: %v", dep.Source, err)
+    }
+    if dep.Name == "" {
+        dep.Name = PackageName(dep.Source, staged)
+    }
+    if !validName(dep.Name) {
+        return LockedDependency{}, fmt.Errorf("install %s: %q is not a valid package name; choose one with --name", dep.Source, dep.Name)
+    }
+    hash, err := HashDir(staged)
+    if err != nil {
+        return LockedDependency{}, err
+    }
+
+    entry := LockedDependency{Name: dep.Name, Source: dep.Source, Hash: hash}
+    if locked := lock.Find(dep.Name); locked != nil && locked.Source == dep.Source && locked.Hash != hash {
+        return LockedDependency{}, fmt.Errorf("checksum mismatch for %s: %s has %s, but %s now has %s; run `athera lock` if the change is expected", dep.Name, LockFile, locked.Hash, dep.Source, hash)
+    }
+
+    dest := filepath.Join(root, dep.Name)
+    if err := os.RemoveAll(dest); err != nil {
+        return LockedDependency{}, err
+    }
+    if err := os.Rename(staged, dest); err != nil {
+        return LockedDependency{}, err
+    }
+    lock.Set(entry)
+    return entry, nil
+}
+
+// PackageName suggests a name for the package source names: the name in
+// its own manifest if dir, where it was fetched to, has one, or else the
+// source's file name without its extension.
+func PackageName(source, dir string) string {
+    if m, err := LoadManifest(dir); err == nil {
+        return m.Name
+    }
+    src, _, _ := sourcePath(source)
+    name := filepath.Base(filepath.Clean(src))
+    for _, ext := range []string{".tar.gz", ".tgz", ".zip", ".git"} {
+        if strings.HasSuffix(strings.ToLower(name), ext) {
+            return name[:len(name)-len(ext)]
+        }
+    }
+    return name
+}
+
+// validName reports whether name can be imported with `use`: letters,
+// digits and underscores, not starting with a digit.
+func validName(name string) bool {
+    for idx, r := range name {
+        letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+        if !letter && (idx == 0 || r < '0' || r > '9') {
+            return false
+        }
+    }
+    return name != ""
+}
+
+func isGitRepo(dir string) bool {
+    _, err := os.Stat(filepath.Join(dir, ".git"))
+    return err == nil
+}
+
+// fetchGit extracts the files of the repository at dir as committed at
+// ref, or HEAD, leaving out uncommitted changes.
+func fetchGit(dir, ref, dest string) error {
+    if ref == "" {
+        ref = "HEAD"
+    }
+    var stdout, stderr bytes.Buffer
+    cmd := exec.Command("git", "-C", dir, "archive", "--format=tar", ref)
+    cmd.Stdout, cmd.Stderr = &stdout, &stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("git archive %s in %s: %v: %s", ref, dir, err, strings.TrimSpace(stderr.String()))
+    }
+    return extractTar(&stdout, dest)
+}
+
+// copyDir copies the regular files under src into dest, skipping hidden
+// files and folders as HashDir does.
+func copyDir(src, dest string) error {
+    return filepath.WalkDir(src, func(p string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if p != src && strings.HasPrefix(entry.Name(), ".") {
+            if entry.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        rel, err := filepath.Rel(src, p)
+        if err != nil {
+            return err
+        }
+        target := filepath.Join(dest, rel)
+        switch {
+        case entry.IsDir():
+            return os.MkdirAll(target, 0o755)
+        case entry.Type().IsRegular():
+            data, err := os.ReadFile(p)
+            if err != nil {
+                return err
+            }
+            return os.WriteFile(target, data, 0o644)
+        }
+        return nil
+    })
+}
+
+func extractTarGz(file, dest string) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    gz, err := gzip.NewReader(f)
+    if err != nil {
+        return err
+    }
+    defer gz.Close()
+    return extractTar(gz, dest)
+}
+
+// extractTar writes the folders and regular files of a tar stream under
+// dest; links and other special entries are skipped.
+func extractTar(r io.Reader, dest string) error {
+    tr := tar.NewReader(r)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        target, err := archiveTarget(dest, header.Name)
+        if err != nil || target == "" {
+            return err
+        }
+        switch header.Typeflag {
+        case tar.TypeDir:
+            err = os.MkdirAll(target, 0o755)
+        case tar.TypeReg:
+            err = writeFile(target, tr)
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
+
+func extractZip(file, dest string) error {
+    zr, err := zip.OpenReader(file)
+    if err != nil {
+        return err
+    }
+    defer zr.Close()
+    for _, f := range zr.File {
+        target, err := archiveTarget(dest, f.Name)
+        if err != nil {
+            return err
+        }
+        if target == "" {
+            continue
+        }
+        if f.FileInfo().IsDir() {
+            if err := os.MkdirAll(target, 0o755); err != nil {
+                return err
+            }
+            continue
+        }
+        if !f.Mode().IsRegular() {
+            continue
+        }
+        rc, err := f.Open()
+        if err != nil {
+            return err
+        }
+        err = writeFile(target, rc)
+        rc.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// archiveTarget returns where an archive entry is extracted to, or "" for
+// the archive's root. Entries that would land outside dest are an error.
+func archiveTarget(dest, name string) (string, error) {
+    clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+    if clean == "." {
+        return "", nil
+    }
+    if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("archive entry %q is outside the package", name)
+    }
+    return filepath.Join(dest, filepath.FromSlash(clean)), nil
+}
+
+func writeFile(target string, r io.Reader) error {
+    if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+        return err
+    }
+    f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(f, r); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// flattenSingleDir moves the contents of dest's only entry up into dest
+// when that entry is a folder, as archives made of a whole folder are.
+func flattenSingleDir(dest string) error {
+    entries, err := os.ReadDir(dest)
+    if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+        return err
+    }
+    inner := filepath.Join(dest, entries[0].Name())
+    children, err := os.ReadDir(inner)
+    if err != nil {
+        return err
+    }
+    // Move the folder aside first, in case it holds an entry of its own
+    // name.
+    aside := inner + ".flatten"
+    if err := os.Rename(inner, aside); err != nil {
+        return err
+    }
+    for _, child := range children {
+        if err := os.Rename(filepath.Join(aside, child.Name()), filepath.Join(dest, child.Name())); err != nil {
+            return err
+        }
+    }
+    return os.Remove(aside)
+}
@@ -0,0 +1,221 @@
+package project
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// archiveEntry is a file, folder or symlink to put in a test archive.
+type archiveEntry struct {
+    name     string
+    body     string
+    linkname string
+    dir      bool
+}
+
+func writeTarGz(t *testing.T, path string, entries []archiveEntry) {
+    t.Helper()
+    f, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    gz := gzip.NewWriter(f)
+    tw := tar.NewWriter(gz)
+    for _, e := range entries {
+        header := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+        switch {
+        case e.dir:
+            header.Typeflag, header.Mode, header.Size = tar.TypeDir, 0o755, 0
+        case e.linkname != "":
+            header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.linkname, 0
+        }
+        if err := tw.WriteHeader(header); err != nil {
+            t.Fatal(err)
+        }
+        if header.Typeflag == tar.TypeReg {
+            if _, err := tw.Write([]byte(e.body)); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := gz.Close(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+    t.Helper()
+    f, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    zw := zip.NewWriter(f)
+    for _, e := range entries {
+        header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+        body := e.body
+        switch {
+        case e.dir:
+            header.Name = strings.TrimSuffix(e.name, "/") + "/"
+            header.SetMode(os.ModeDir | 0o755)
+        case e.linkname != "":
+            header.SetMode(os.ModeSymlink | 0o777)
+            body = e.linkname
+        default:
+            header.SetMode(0o644)
+        }
+        w, err := zw.CreateHeader(header)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := w.Write([]byte(body)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// writeArchive writes entries as a .tar.gz or .zip, by the extension of
+// name, in a new temporary folder and returns its path.
+func writeArchive(t *testing.T, name string, entries []archiveEntry) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if strings.HasSuffix(name, ".zip") {
+        writeZip(t, path, entries)
+    } else {
+        writeTarGz(t, path, entries)
+    }
+    return path
+}
+
+func TestFetchRejectsEntriesOutsideThePackage(t *testing.T) {
+    for _, archive := range []string{"pkg.tar.gz", "pkg.zip"} {
+        for _, name := range []string{"../evil.ath", "lib/../../evil.ath", "/tmp/evil.ath", `..\evil.ath`} {
+            t.Run(archive+" "+name, func(t *testing.T) {
+                src := writeArchive(t, archive, []archiveEntry{
+                    {name: "main.ath", body: "greet 1\n"},
+                    {name: name, body: "greet 2\n"},
+                })
+                parent := t.TempDir()
+                dest := filepath.Join(parent, "pkg")
+                err := Fetch(src, "", dest)
+                if err == nil || !strings.Contains(err.Error(), "outside the package") {
+                    t.Fatalf("Fetch error = %v, want an entry outside the package", err)
+                }
+                if _, err := os.Stat(filepath.Join(parent, "evil.ath")); err == nil {
+                    t.Fatalf("entry %q was written outside the package", name)
+                }
+            })
+        }
+    }
+}
+
+func TestFetchSkipsSymlinks(t *testing.T) {
+    for _, archive := range []string{"pkg.tar.gz", "pkg.zip"} {
+        t.Run(archive, func(t *testing.T) {
+            src := writeArchive(t, archive, []archiveEntry{
+                {name: "main.ath", body: "greet 1\n"},
+                {name: "passwd", linkname: "/etc/passwd"},
+            })
+            dest := filepath.Join(t.TempDir(), "pkg")
+            if err := Fetch(src, "", dest); err != nil {
+                t.Fatal(err)
+            }
+            if _, err := os.Lstat(filepath.Join(dest, "passwd")); !os.IsNotExist(err) {
+                t.Fatalf("symlink was extracted (Lstat error %v)", err)
+            }
+            if _, err := os.Stat(filepath.Join(dest, "main.ath")); err != nil {
+                t.Fatal(err)
+            }
+        })
+    }
+}
+
+func TestFetchFlattensSingleFolder(t *testing.T) {
+    src := writeArchive(t, "pkg.tar.gz", []archiveEntry{
+        {name: "greeter-1.0", dir: true},
+        {name: "greeter-1.0/greeter.ath", body: "greet 1\n"},
+        {name: "greeter-1.0/greeter-1.0/inner.ath", body: "greet 2\n"},
+    })
+    dest := filepath.Join(t.TempDir(), "pkg")
+    if err := Fetch(src, "", dest); err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"greeter.ath", filepath.Join("greeter-1.0", "inner.ath")} {
+        if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+            t.Errorf("%s not installed: %v", name, err)
+        }
+    }
+}
+
+// stagingDirs lists the .install-* folders left in root.
+func stagingDirs(t *testing.T, root string) []string {
+    t.Helper()
+    matches, err := filepath.Glob(filepath.Join(root, ".install-*"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return matches
+}
+
+func TestInstallRejectsHashMismatch(t *testing.T) {
+    base := t.TempDir()
+    pkg := filepath.Join(base, "greeter")
+    if err := os.MkdirAll(pkg, 0o755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(pkg, "greeter.ath"), []byte("greet 1\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    root := filepath.Join(base, "athera_modules")
+    dep := Dependency{Name: "greeter", Source: "./greeter"}
+    lock := &Lock{}
+    entry, err := Install(root, base, dep, lock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := os.WriteFile(filepath.Join(pkg, "greeter.ath"), []byte("greet 2\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    _, err = Install(root, base, dep, lock)
+    if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+        t.Fatalf("Install error = %v, want a checksum mismatch", err)
+    }
+    if got := lock.Find("greeter"); got == nil || got.Hash != entry.Hash {
+        t.Errorf("lock entry = %+v, want the original hash %s", got, entry.Hash)
+    }
+    data, err := os.ReadFile(filepath.Join(root, "greeter", "greeter.ath"))
+    if err != nil || string(data) != "greet 1\n" {
+        t.Errorf("installed copy = %q, %v; want it left as it was", data, err)
+    }
+    if dirs := stagingDirs(t, root); len(dirs) > 0 {
+        t.Errorf("staging folders left behind: %v", dirs)
+    }
+}
+
+func TestInstallRemovesStagingOnFailure(t *testing.T) {
+    base := t.TempDir()
+    root := filepath.Join(base, "athera_modules")
+    src := writeArchive(t, "pkg.zip", []archiveEntry{{name: "../evil.ath", body: "greet 1\n"}})
+    if _, err := Install(root, base, Dependency{Name: "evil", Source: src}, &Lock{}); err == nil {
+        t.Fatal("Install succeeded, want an error")
+    }
+    if dirs := stagingDirs(t, root); len(dirs) > 0 {
+        t.Errorf("staging folders left behind: %v", dirs)
+    }
+    if _, err := os.Stat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+        t.Errorf("failed package was installed (Stat error %v)", err)
+    }
+}
@@ -0,0 +1,185 @@
+package project
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// LockFile is the name of the lockfile written next to the manifest.
+const LockFile = "athera.lock"
+
+// lockVersion is the format version written to athera.lock.
+const lockVersion = "1"
+
+// Lock records the exact contents of each dependency, so that a project
+// runs against the same code it was locked with.
+type Lock struct {
+    Dependencies []LockedDependency
+}
+
+// LockedDependency is a dependency and the hash of its contents when it
+// was locked.
+type LockedDependency struct {
+    Name   string
+    Source string
+    Hash   string
+}
+
+// ResolveLock hashes the current contents of every dependency of m.
+func ResolveLock(m *Manifest) (*Lock, error) {
+    lock := &Lock{}
+    for _, dep := range m.Dependencies {
+        hash, err := HashSource(dep.Source, m.Dir)
+        if err != nil {
+            return nil, fmt.Errorf("dependency %s: %v", dep.Name, err)
+        }
+        lock.Dependencies = append(lock.Dependencies, LockedDependency{Name: dep.Name, Source: dep.Source, Hash: hash})
+    }
+    return lock, nil
+}
+
+// HashDir returns the SHA-256 of a folder's files: the hash covers each
+// file's path within the folder and its contents, in sorted order, so it
+// changes when any file is added, removed, renamed or edited. Hidden
+// files and folders are skipped.
+func HashDir(dir string) (string, error) {
+    info, err := os.Stat(dir)
+    if err != nil {
+        return "", err
+    }
+    if !info.IsDir() {
+        return "", fmt.Errorf("%s is not a folder", dir)
+    }
+
+    h := sha256.New()
+    err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if path != dir && strings.HasPrefix(entry.Name(), ".") {
+            if entry.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !entry.Type().IsRegular() {
+            return nil
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(dir, path)
+        if err != nil {
+            return err
+        }
+        sum := sha256.Sum256(data)
+        fmt.Fprintf(h, "%s\x00%x\n", filepath.ToSlash(rel), sum)
+        return nil
+    })
+    if err != nil {
+        return "", err
+    }
+    return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadLock reads the lockfile in dir. It returns an error satisfying
+// errors.Is(err, fs.ErrNotExist) if there is none.
+func ReadLock(dir string) (*Lock, error) {
+    path := filepath.Join(dir, LockFile)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    lock, err := ParseLock(string(data))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return lock, nil
+}
+
+// ParseLock parses the text of a lockfile.
+func ParseLock(src string) (*Lock, error) {
+    doc, err := parseYAML(src)
+    if err != nil {
+        return nil, err
+    }
+    if version, _ := doc["version"].(string); version != lockVersion {
+        return nil, fmt.Errorf("unsupported lockfile version %q", doc["version"])
+    }
+
+    lock := &Lock{}
+    deps, ok := doc["dependencies"].(map[string]any)
+    if !ok && doc["dependencies"] != nil && doc["dependencies"] != "" {
+        return nil, fmt.Errorf("dependencies must map package names to entries")
+    }
+    for name, item := range deps {
+        entry, ok := item.(map[string]any)
+        if !ok {
+            return nil, fmt.Errorf("dependency %s: expected source and sha256", name)
+        }
+        source, _ := entry["source"].(string)
+        hash, _ := entry["sha256"].(string)
+        if source == "" || hash == "" {
+            return nil, fmt.Errorf("dependency %s: expected source and sha256", name)
+        }
+        lock.Dependencies = append(lock.Dependencies, LockedDependency{Name: name, Source: source, Hash: "sha256:" + hash})
+    }
+    sort.Slice(lock.Dependencies, func(a, b int) bool {
+        return lock.Dependencies[a].Name < lock.Dependencies[b].Name
+    })
+    return lock, nil
+}
+
+// Format returns the lockfile text. Dependencies are written in name
+// order, so the same dependencies always give the same file.
+func (l *Lock) Format() string {
+    var b strings.Builder
+    b.WriteString("# athera.lock is generated by athera; do not edit it by hand.\n")
+    b.WriteString("version: " + lockVersion + "\n")
+    if len(l.Dependencies) == 0 {
+        b.WriteString("dependencies: {}\n")
+        return b.String()
+    }
+    b.WriteString("dependencies:\n")
+    for _, dep := range l.Dependencies {
+        fmt.Fprintf(&b, "  %s:\n", quoteYAML(dep.Name))
+        fmt.Fprintf(&b, "    source: %s\n", quoteYAML(dep.Source))
+        fmt.Fprintf(&b, "    sha256: %s\n", strings.TrimPrefix(dep.Hash, "sha256:"))
+    }
+    return b.String()
+}
+
+// Find returns the locked entry for the dependency name, or nil.
+func (l *Lock) Find(name string) *LockedDependency {
+    for idx := range l.Dependencies {
+        if l.Dependencies[idx].Name == name {
+            return &l.Dependencies[idx]
+        }
+    }
+    return nil
+}
+
+// Set adds or replaces the entry for a dependency, keeping entries in
+// name order.
+func (l *Lock) Set(entry LockedDependency) {
+    if old := l.Find(entry.Name); old != nil {
+        *old = entry
+        return
+    }
+    l.Dependencies = append(l.Dependencies, entry)
+    sort.Slice(l.Dependencies, func(a, b int) bool {
+        return l.Dependencies[a].Name < l.Dependencies[b].Name
+    })
+}
+
+// Write saves the lockfile in dir.
+func (l *Lock) Write(dir string) error {
+    return os.WriteFile(filepath.Join(dir, LockFile), []byte(l.Format()), 0o644)
+}
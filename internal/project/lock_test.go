@@ -0,0 +1,99 @@
+package project
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// writeTree creates files, given by slash-separated path, under dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+    t.Helper()
+    for name, body := range files {
+        path := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestLockIsReproducible(t *testing.T) {
+    dir := t.TempDir()
+    writeTree(t, dir, map[string]string{
+        "athera.yaml":          "name: app\ndependencies:\n  zeta: ./pkgs/zeta\n  alpha: ./pkgs/alpha\n  'mid': ./pkgs/mid\n",
+        "pkgs/zeta/zeta.ath":   "greet 1\n",
+        "pkgs/alpha/main.ath":  "greet 2\n",
+        "pkgs/alpha/lib/x.ath": "greet 3\n",
+        "pkgs/mid/mid.ath":     "greet 4\n",
+    })
+    m, err := LoadManifest(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    first, err := ResolveLock(m)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := first.Write(dir); err != nil {
+        t.Fatal(err)
+    }
+    written, err := os.ReadFile(filepath.Join(dir, LockFile))
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := ResolveLock(m)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := second.Format(); got != string(written) {
+        t.Errorf("second lockfile differs:\n%s\nfirst:\n%s", got, written)
+    }
+
+    read, err := ReadLock(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(read, first) {
+        t.Errorf("ReadLock = %+v, want %+v", read, first)
+    }
+    if read.Format() != string(written) {
+        t.Errorf("lockfile does not round-trip:\n%s\nwant\n%s", read.Format(), written)
+    }
+}
+
+func TestHashDirChangesWithContents(t *testing.T) {
+    dir := t.TempDir()
+    writeTree(t, dir, map[string]string{"a.ath": "greet 1\n", ".git/HEAD": "ref\n"})
+    before, err := HashDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    writeTree(t, dir, map[string]string{".git/HEAD": "other\n"})
+    if hidden, _ := HashDir(dir); hidden != before {
+        t.Errorf("hash changed with a hidden file: %s, was %s", hidden, before)
+    }
+    if err := os.Rename(filepath.Join(dir, "a.ath"), filepath.Join(dir, "b.ath")); err != nil {
+        t.Fatal(err)
+    }
+    if renamed, _ := HashDir(dir); renamed == before {
+        t.Errorf("hash did not change when a file was renamed")
+    }
+}
+
+func TestParseLockErrors(t *testing.T) {
+    for _, src := range []string{
+        "version: 2\ndependencies: {}\n",
+        "version: 1\ndependencies:\n  a:\n    source: ./a\n",
+        "version: 1\ndependencies: ./a\n",
+    } {
+        if _, err := ParseLock(src); err == nil {
+            t.Errorf("ParseLock(%q) succeeded, want an error", src)
+        }
+    }
+}
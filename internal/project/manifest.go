@@ -0,0 +1,247 @@
+// Package project reads Athera project manifests (athera.yaml) and
+// lockfiles (athera.lock).
+package project
+
+import (
+    "fmt"
+    "io/fs"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// ManifestFile is the name of the project manifest.
+const ManifestFile = "athera.yaml"
+
+// DefaultEntry is the entry point of a project whose manifest names none.
+const DefaultEntry = "main.ath"
+
+// Manifest describes a project: its name and version, the program
+// `athera run` starts, extra folders to search for modules, and the
+// packages it depends on.
+type Manifest struct {
+    Name         string
+    Version      string
+    Entry        string
+    Paths        []string
+    Dependencies []Dependency
+    // Dir is the folder holding the manifest; relative paths in it are
+    // relative to Dir.
+    Dir string
+}
+
+// Dependency is a package the project uses: a folder of modules given by
+// a local path or a file:// URL.
+type Dependency struct {
+    Name   string
+    Source string
+}
+
+// LoadManifest reads the manifest in dir.
+func LoadManifest(dir string) (*Manifest, error) {
+    path := filepath.Join(dir, ManifestFile)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    m, err := ParseManifest(string(data))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if m.Dir, err = filepath.Abs(dir); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// FindManifest returns the folder holding the manifest that applies in
+// dir: dir's own, or else that of the nearest folder above it with one. It
+// returns an error satisfying errors.Is(err, fs.ErrNotExist) if there is
+// none.
+func FindManifest(dir string) (string, error) {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return "", err
+    }
+    for {
+        if info, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil && !info.IsDir() {
+            return dir, nil
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return "", fmt.Errorf("no %s found: %w", ManifestFile, fs.ErrNotExist)
+        }
+        dir = parent
+    }
+}
+
+// ParseManifest parses the text of a manifest. Keys other than name,
+// version, entry, paths and dependencies, such as description or author,
+// are allowed and ignored.
+func ParseManifest(src string) (*Manifest, error) {
+    doc, err := parseYAML(src)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &Manifest{Entry: DefaultEntry}
+    for key, target := range map[string]*string{"name": &m.Name, "version": &m.Version, "entry": &m.Entry} {
+        if value, ok := doc[key]; ok {
+            s, isString := value.(string)
+            if !isString || s == "" {
+                return nil, fmt.Errorf("%s must be a single value", key)
+            }
+            *target = s
+        }
+    }
+    if m.Name == "" {
+        return nil, fmt.Errorf("name is required")
+    }
+
+    if value, ok := doc["paths"]; ok {
+        paths, isList := value.([]any)
+        if !isList {
+            return nil, fmt.Errorf("paths must be a list of folders")
+        }
+        for _, item := range paths {
+            path, isString := item.(string)
+            if !isString || path == "" {
+                return nil, fmt.Errorf("paths must be a list of folders")
+            }
+            m.Paths = append(m.Paths, path)
+        }
+    }
+
+    if value, ok := doc["dependencies"]; ok && value != "" {
+        deps, isMap := value.(map[string]any)
+        if !isMap {
+            return nil, fmt.Errorf("dependencies must map package names to sources")
+        }
+        for name, item := range deps {
+            source, isString := item.(string)
+            if !isString || source == "" {
+                return nil, fmt.Errorf("dependency %s: source must be a local path or a file:// URL", name)
+            }
+            if _, _, err := sourcePath(source); err != nil {
+                return nil, fmt.Errorf("dependency %s: %v", name, err)
+            }
+            if !validName(name) {
+                return nil, fmt.Errorf("dependency %s: package names may only hold letters, digits and underscores", name)
+            }
+            m.Dependencies = append(m.Dependencies, Dependency{Name: name, Source: source})
+        }
+        sort.Slice(m.Dependencies, func(a, b int) bool {
+            return m.Dependencies[a].Name < m.Dependencies[b].Name
+        })
+    }
+    return m, nil
+}
+
+// sourcePath returns the file path a dependency source names, and the
+// git revision after a `#`, if any.
+func sourcePath(source string) (string, string, error) {
+    if !strings.Contains(source, "://") {
+        path, ref := source, ""
+        if idx := strings.LastIndex(source, "#"); idx >= 0 {
+            path, ref = source[:idx], source[idx+1:]
+        }
+        return filepath.FromSlash(path), ref, nil
+    }
+    u, err := url.Parse(source)
+    if err != nil {
+        return "", "", err
+    }
+    if u.Scheme != "file" {
+        return "", "", fmt.Errorf("unsupported source %q; use a local path or a file:// URL", source)
+    }
+    if u.Host != "" && u.Host != "localhost" {
+        return "", "", fmt.Errorf("file URL %q must not name a host", source)
+    }
+    return filepath.FromSlash(u.Path), u.Fragment, nil
+}
+
+// EntryPath returns the path of the project's entry program.
+func (m *Manifest) EntryPath() string {
+    return m.resolve(m.Entry)
+}
+
+// ModulePaths lists the folders in the manifest's paths, to search for
+// the project's modules. Dependencies are found where `athera install`
+// puts them instead.
+func (m *Manifest) ModulePaths() []string {
+    var dirs []string
+    for _, path := range m.Paths {
+        dirs = append(dirs, m.resolve(path))
+    }
+    return dirs
+}
+
+// AddDependency records a dependency in the manifest in dir, replacing
+// any entry of the same name. The file is edited in place, so its layout
+// and comments are kept.
+func AddDependency(dir string, dep Dependency) error {
+    path := filepath.Join(dir, ManifestFile)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+    entry := dep.Name + ": " + quoteYAML(dep.Source)
+
+    // Find the top-level dependencies key, the end of its block, and the
+    // indentation and position of its entries.
+    start, end, indent := -1, len(lines), "  "
+    for idx, line := range lines {
+        text := stripComment(line)
+        if start < 0 {
+            if text == "dependencies:" || strings.HasPrefix(text, "dependencies: ") {
+                start, end = idx, idx+1
+            }
+            continue
+        }
+        if text == "" {
+            continue
+        }
+        if !strings.HasPrefix(line, " ") {
+            break
+        }
+        end = idx + 1
+        trimmed := strings.TrimLeft(text, " ")
+        indent = line[:len(line)-len(trimmed)]
+        if key, _, ok := splitKey(trimmed); ok && key == dep.Name {
+            lines[idx] = indent + entry
+            return writeManifest(path, lines)
+        }
+    }
+
+    switch {
+    case start < 0:
+        lines = append(lines, "dependencies:", indent+entry)
+    case strings.TrimSpace(strings.TrimPrefix(stripComment(lines[start]), "dependencies:")) != "":
+        // `dependencies: {}` becomes a block holding the entry.
+        lines[start] = "dependencies:"
+        lines = append(lines[:start+1], append([]string{indent + entry}, lines[start+1:]...)...)
+    default:
+        lines = append(lines[:end], append([]string{indent + entry}, lines[end:]...)...)
+    }
+    return writeManifest(path, lines)
+}
+
+// writeManifest saves the edited manifest lines, after checking that they
+// still parse.
+func writeManifest(path string, lines []string) error {
+    text := strings.Join(lines, "\n") + "\n"
+    if _, err := ParseManifest(text); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    return os.WriteFile(path, []byte(text), 0o644)
+}
+
+func (m *Manifest) resolve(path string) string {
+    if filepath.IsAbs(path) {
+        return filepath.Clean(path)
+    }
+    return filepath.Join(m.Dir, path)
+}
@@ -0,0 +1,126 @@
+package project
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseManifest(t *testing.T) {
+    src := `# A project with every key.
+name: "my project"    # quoted, with a space
+version: '1.0.0'
+description: ignored
+entry: src/main.ath
+paths:
+  - lib
+  - "vendor/lib # not a comment"
+dependencies:
+  # comments between entries are skipped
+  greeter: ./vendor/greeter
+  shared: "file:///home/me/athera/shared.tar.gz"
+  tools: ../tools#v1.2
+`
+    m, err := ParseManifest(src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := &Manifest{
+        Name:    "my project",
+        Version: "1.0.0",
+        Entry:   "src/main.ath",
+        Paths:   []string{"lib", "vendor/lib # not a comment"},
+        Dependencies: []Dependency{
+            {Name: "greeter", Source: "./vendor/greeter"},
+            {Name: "shared", Source: "file:///home/me/athera/shared.tar.gz"},
+            {Name: "tools", Source: "../tools#v1.2"},
+        },
+    }
+    if !reflect.DeepEqual(m, want) {
+        t.Errorf("ParseManifest =\n%+v\nwant\n%+v", m, want)
+    }
+}
+
+func TestParseManifestDefaults(t *testing.T) {
+    m, err := ParseManifest("name: app\ndependencies: {}\n")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if m.Entry != DefaultEntry || m.Paths != nil || m.Dependencies != nil {
+        t.Errorf("ParseManifest = %+v, want the default entry and nothing else", m)
+    }
+}
+
+func TestParseManifestErrors(t *testing.T) {
+    cases := []struct {
+        name, src, want string
+    }{
+        {"indented too far", "name: app\n  version: 1\n", "line 2: unexpected indentation"},
+        {"dependency indented unevenly", "name: app\ndependencies:\n  a: ./a\n    b: ./b\n", "line 4: unexpected indentation"},
+        {"tab indentation", "name: app\ndependencies:\n\ta: ./a\n", "line 3: tabs are not allowed"},
+        {"missing name", "version: 1\n", "name is required"},
+        {"duplicate key", "name: a\nname: b\n", `line 2: duplicate key "name"`},
+        {"paths not a list", "name: app\npaths: lib\n", "paths must be a list"},
+        {"nested dependency", "name: app\ndependencies:\n  a:\n    source: ./a\n", "dependency a: source must be"},
+        {"bad package name", "name: app\ndependencies:\n  my-pkg: ./a\n", "dependency my-pkg: package names"},
+        {"remote source", "name: app\ndependencies:\n  a: https://example.com/a\n", "unsupported source"},
+        {"flow collection", "name: app\npaths: [lib]\n", "flow collections are not supported"},
+        {"unterminated quote", "name: \"app\n", "bad quoted string"},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := ParseManifest(tc.src)
+            if err == nil || !strings.Contains(err.Error(), tc.want) {
+                t.Errorf("ParseManifest error = %v, want one containing %q", err, tc.want)
+            }
+        })
+    }
+}
+
+func TestAddDependencyKeepsLayout(t *testing.T) {
+    dir := t.TempDir()
+    src := `# my project
+name: app   # the name
+
+dependencies:
+    # local packages
+    greeter: ./greeter
+entry: main.ath
+`
+    if err := os.WriteFile(filepath.Join(dir, ManifestFile), []byte(src), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := AddDependency(dir, Dependency{Name: "shared", Source: "../shared lib"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := AddDependency(dir, Dependency{Name: "greeter", Source: "./greeter#v2"}); err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `# my project
+name: app   # the name
+
+dependencies:
+    # local packages
+    greeter: "./greeter#v2"
+    shared: ../shared lib
+entry: main.ath
+`
+    if string(data) != want {
+        t.Errorf("manifest =\n%s\nwant\n%s", data, want)
+    }
+    m, err := LoadManifest(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    deps := []Dependency{{Name: "greeter", Source: "./greeter#v2"}, {Name: "shared", Source: "../shared lib"}}
+    if !reflect.DeepEqual(m.Dependencies, deps) {
+        t.Errorf("dependencies = %+v, want %+v", m.Dependencies, deps)
+    }
+}
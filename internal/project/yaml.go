@@ -0,0 +1,251 @@
+package project
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// yamlLine is one line of YAML that holds content: its indentation, its
+// text without indentation or comment, and its line number.
+type yamlLine struct {
+    indent int
+    text   string
+    num    int
+}
+
+// parseYAML reads the subset of YAML that athera.yaml and athera.lock
+// use: mappings and lists nested by indentation, plain and quoted
+// strings, and comments. Flow collections other than the empty `[]` and
+// `{}`, anchors and multi-line strings are not supported. Every scalar is
+// returned as a string.
+func parseYAML(src string) (map[string]any, error) {
+    var lines []yamlLine
+    for idx, raw := range strings.Split(src, "\n") {
+        raw = strings.TrimRight(raw, " \r")
+        text := strings.TrimLeft(raw, " ")
+        if strings.HasPrefix(text, "\t") {
+            return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", idx+1)
+        }
+        text = stripComment(text)
+        if text == "" || text == "---" {
+            continue
+        }
+        lines = append(lines, yamlLine{indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text, num: idx + 1})
+    }
+    if len(lines) == 0 {
+        return map[string]any{}, nil
+    }
+
+    p := &yamlParser{lines: lines}
+    value, err := p.block(lines[0].indent)
+    if err != nil {
+        return nil, err
+    }
+    if p.pos < len(lines) {
+        return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].num)
+    }
+    doc, ok := value.(map[string]any)
+    if !ok {
+        return nil, fmt.Errorf("line %d: expected a mapping of keys to values", lines[0].num)
+    }
+    return doc, nil
+}
+
+// stripComment removes a `#` comment that is outside quotes and starts
+// the text or follows a space.
+func stripComment(text string) string {
+    var quote rune
+    for idx, r := range text {
+        switch {
+        case quote != 0:
+            if r == quote {
+                quote = 0
+            }
+        case (r == '"' || r == '\'') && (idx == 0 || text[idx-1] == ' '):
+            quote = r
+        case r == '#' && (idx == 0 || text[idx-1] == ' '):
+            return strings.TrimRight(text[:idx], " ")
+        }
+    }
+    return text
+}
+
+type yamlParser struct {
+    lines []yamlLine
+    pos   int
+}
+
+// block parses the mapping or list whose entries start at indent.
+func (p *yamlParser) block(indent int) (any, error) {
+    if isListItem(p.lines[p.pos].text) {
+        return p.list(indent)
+    }
+    return p.mapping(indent)
+}
+
+func isListItem(text string) bool {
+    return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+    result := make(map[string]any)
+    for p.pos < len(p.lines) {
+        line := p.lines[p.pos]
+        if line.indent < indent {
+            break
+        }
+        if line.indent > indent {
+            return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+        }
+        if isListItem(line.text) {
+            return nil, fmt.Errorf("line %d: expected a key, found a list item", line.num)
+        }
+        key, rest, ok := splitKey(line.text)
+        if !ok {
+            return nil, fmt.Errorf("line %d: expected `key: value`, found %q", line.num, line.text)
+        }
+        if _, dup := result[key]; dup {
+            return nil, fmt.Errorf("line %d: duplicate key %q", line.num, key)
+        }
+        p.pos++
+
+        if rest != "" {
+            value, err := scalar(rest, line.num)
+            if err != nil {
+                return nil, err
+            }
+            result[key] = value
+            continue
+        }
+        // A key with nothing after it holds the indented block below it,
+        // or a list written at the key's own indentation.
+        switch {
+        case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+            value, err := p.block(p.lines[p.pos].indent)
+            if err != nil {
+                return nil, err
+            }
+            result[key] = value
+        case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isListItem(p.lines[p.pos].text):
+            value, err := p.list(indent)
+            if err != nil {
+                return nil, err
+            }
+            result[key] = value
+        default:
+            result[key] = ""
+        }
+    }
+    return result, nil
+}
+
+func (p *yamlParser) list(indent int) ([]any, error) {
+    var result []any
+    for p.pos < len(p.lines) {
+        line := p.lines[p.pos]
+        if line.indent != indent || !isListItem(line.text) {
+            break
+        }
+        item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+        if item == "" {
+            p.pos++
+            if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+                result = append(result, "")
+                continue
+            }
+            value, err := p.block(p.lines[p.pos].indent)
+            if err != nil {
+                return nil, err
+            }
+            result = append(result, value)
+            continue
+        }
+        if _, _, isKey := splitKey(item); isKey {
+            // `- key: value` starts a mapping indented to where key is.
+            offset := indent + len(line.text) - len(item)
+            p.lines[p.pos] = yamlLine{indent: offset, text: item, num: line.num}
+            value, err := p.mapping(offset)
+            if err != nil {
+                return nil, err
+            }
+            result = append(result, value)
+            continue
+        }
+        value, err := scalar(item, line.num)
+        if err != nil {
+            return nil, err
+        }
+        result = append(result, value)
+        p.pos++
+    }
+    return result, nil
+}
+
+// splitKey splits `key: value` into its key and the rest of the line. The
+// key may be quoted.
+func splitKey(text string) (string, string, bool) {
+    if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+        end := strings.IndexByte(text[1:], text[0])
+        if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+            return "", "", false
+        }
+        key, err := unquote(text[:end+2])
+        if err != nil {
+            return "", "", false
+        }
+        return key, strings.TrimSpace(text[end+3:]), true
+    }
+    idx := strings.Index(text, ": ")
+    if idx < 0 {
+        if !strings.HasSuffix(text, ":") {
+            return "", "", false
+        }
+        idx = len(text) - 1
+    }
+    key := strings.TrimSpace(text[:idx])
+    if key == "" || strings.ContainsAny(key, "[]{}") {
+        return "", "", false
+    }
+    return key, strings.TrimSpace(text[idx+1:]), true
+}
+
+// scalar reads a value written on the line of its key or list item.
+func scalar(text string, num int) (any, error) {
+    switch {
+    case text == "[]":
+        return []any{}, nil
+    case text == "{}":
+        return map[string]any{}, nil
+    case strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{"):
+        return nil, fmt.Errorf("line %d: flow collections are not supported; write one item per line", num)
+    case strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || text == "|" || text == ">":
+        return nil, fmt.Errorf("line %d: anchors and multi-line strings are not supported", num)
+    case strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'"):
+        value, err := unquote(text)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: bad quoted string %s", num, text)
+        }
+        return value, nil
+    }
+    return text, nil
+}
+
+func unquote(text string) (string, error) {
+    if strings.HasPrefix(text, "'") {
+        if len(text) < 2 || !strings.HasSuffix(text, "'") {
+            return "", fmt.Errorf("unterminated string")
+        }
+        return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+    }
+    return strconv.Unquote(text)
+}
+
+// quoteYAML writes s as a plain scalar if it reads back unchanged, or
+// else as a double-quoted string.
+func quoteYAML(s string) string {
+    if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s, "\"'#:[]{}&*|>\\\n\t") || strings.HasPrefix(s, "-") {
+        return strconv.Quote(s)
+    }
+    return s
+}